@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Annotation is a set of grafana annotations (e.g. deploys or incidents) whose events are the rows of a
+// query's results. The query is run with the range of the annotation request so it can use $__timeFilter
+type Annotation struct {
+	Name                string   `json:"name"`
+	QueryName           string   `json:"query_name"`
+	TimeColumnHeader    string   `json:"time_column_header"`
+	TimeEndColumnHeader string   `json:"time_end_column_header"` // optional, the rows are regions from time to time end
+	TitleColumnHeader   string   `json:"title_column_header"`    // optional
+	TextColumnHeader    string   `json:"text_column_header"`     // optional
+	TagsColumnHeader    string   `json:"tags_column_header"`     // optional, a comma separated list of tags
+	Tags                []string `json:"tags"`                   // added to the tags of every event
+	AllowedClients      []string `json:"allowed_clients"`        // names of the clients that may use the annotation
+	AllowedRoles        []string `json:"allowed_roles"`          // roles of the clients that may use the annotation, both empty is everyone
+}
+
+// AnnotationEvent is one row of an annotation's query
+type AnnotationEvent struct {
+	Time    time.Time
+	TimeEnd time.Time // zero if the event is not a region
+	Title   string
+	Text    string
+	Tags    []string
+}
+
+// returns
+// the events of the annotation within the params time range, in query result order
+// http status code to use in rsp
+// error string to pass back if error
+func getAnnotationEvents(ctx context.Context, annotationName string, params QueryParameters) ([]AnnotationEvent, int, string) {
+	cfg := currentConfig()
+	annotation, found := cfg.annotationMap[annotationName]
+	if found != true {
+		return nil, http.StatusNotFound, "Could not find annotation in annotation map " + annotationName
+	}
+	if httpCode, errorString := checkACLAccess(ctx, "annotation "+annotation.Name, annotation.AllowedClients, annotation.AllowedRoles); errorString != "" {
+		return nil, httpCode, errorString
+	}
+	query, found := cfg.queryMap[annotation.QueryName]
+	if found != true {
+		return nil, http.StatusNotFound, "Could not find query in query map " + annotation.QueryName
+	}
+	db, found := cfg.dbMap[query.DatabaseName]
+	if found != true {
+		return nil, http.StatusNotFound, "Could not find database in DB map " + query.DatabaseName
+	}
+
+	datablock, err, _ := getDatablockAndUpdateIfNeeded(ctx, db, query, params)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Error getting results from query " + err.Error()
+	}
+
+	timeColumnIndex := columnIndexForHeader(datablock.ColumnList, annotation.TimeColumnHeader)
+	if timeColumnIndex == -1 {
+		return nil, http.StatusInternalServerError, "Could not find annotation time column in query " + query.Name
+	}
+	// -1 for the optional columns that are not set
+	columnIndexes := make(map[string]int)
+	for _, column := range annotation.optionalColumns() {
+		field, header := column[0], column[1]
+		columnIndexes[field] = -1
+		if header == "" {
+			continue
+		}
+		columnIndexes[field] = columnIndexForHeader(datablock.ColumnList, header)
+		if columnIndexes[field] == -1 {
+			return nil, http.StatusInternalServerError, "Could not find annotation " + field + " " + header + " in query " + query.Name
+		}
+	}
+
+	var events []AnnotationEvent
+	dblockRows := datablock.Rowdata
+	for _, k := range sortedKeysForDataBlockData(dblockRows) {
+		row := dblockRows[k]
+		eventTime, ok := timeFromValue(rowValue(row, timeColumnIndex))
+		if !ok {
+			continue
+		}
+		event := AnnotationEvent{
+			Time:  eventTime,
+			Title: variableValueString(rowValue(row, columnIndexes["title_column_header"])),
+			Text:  variableValueString(rowValue(row, columnIndexes["text_column_header"])),
+			Tags:  append(splitTags(variableValueString(rowValue(row, columnIndexes["tags_column_header"]))), annotation.Tags...),
+		}
+		if timeEnd, ok := timeFromValue(rowValue(row, columnIndexes["time_end_column_header"])); ok && timeEnd.After(eventTime) {
+			event.TimeEnd = timeEnd
+		}
+
+		// the query may not filter on the range itself, an event is in the range if any of it is
+		eventEnd := event.TimeEnd
+		if eventEnd.IsZero() {
+			eventEnd = event.Time
+		}
+		if eventEnd.Before(params.TimeRange.From) || event.Time.After(params.TimeRange.To) {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, http.StatusOK, ""
+}
+
+// the json field and header of the optional columns of the annotation
+func (annotation Annotation) optionalColumns() [][2]string {
+	return [][2]string{
+		{"time_end_column_header", annotation.TimeEndColumnHeader},
+		{"title_column_header", annotation.TitleColumnHeader},
+		{"text_column_header", annotation.TextColumnHeader},
+		{"tags_column_header", annotation.TagsColumnHeader},
+	}
+}
+
+// returns the value of the row's column, nil if the column index is -1 (not set) or past the row
+func rowValue(row []interface{}, columnIndex int) interface{} {
+	if columnIndex < 0 || columnIndex >= len(row) {
+		return nil
+	}
+	return row[columnIndex]
+}
+
+// splits a comma separated list of tags, leaving out empty tags
+func splitTags(tags string) []string {
+	var tagList []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tagList = append(tagList, tag)
+		}
+	}
+	return tagList
+}
+
+// the simple json datasource sends the annotation name as the query of the annotation, the name of
+// the grafana annotation is used if the query is empty
+func (r GrafanaAnnotationRequest) annotationName() string {
+	if r.Annotation.Query != "" {
+		return r.Annotation.Query
+	}
+	return r.Annotation.Name
+}
+
+func postAnnotationsHandler(writer http.ResponseWriter, request *http.Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var annotationRequest GrafanaAnnotationRequest
+	err = json.Unmarshal(body, &annotationRequest)
+	if err != nil {
+		http.Error(writer, "Invalid annotation request json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if annotationRequest.annotationName() == "" {
+		http.Error(writer, "Invalid annotation request: no annotation query", http.StatusBadRequest)
+		return
+	}
+
+	params := defaultQueryParameters()
+	params.TimeRange, err = timeRangeFromGrafanaRequest(GrafanaQueryRequest{Range: annotationRequest.Range})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, httpCode, errorString := getAnnotationEvents(request.Context(), annotationRequest.annotationName(), params)
+	if errorString != "" {
+		http.Error(writer, errorString, httpCode)
+		return
+	}
+
+	response := []GrafanaAnnotationResponseElement{}
+	for _, event := range events {
+		element := GrafanaAnnotationResponseElement{
+			Annotation: annotationRequest.Annotation,
+			Time:       event.Time.UnixNano() / int64(time.Millisecond),
+			Title:      event.Title,
+			Text:       event.Text,
+			Tags:       event.Tags,
+		}
+		if !event.TimeEnd.IsZero() {
+			element.TimeEnd = event.TimeEnd.UnixNano() / int64(time.Millisecond)
+			element.IsRegion = true
+		}
+		if element.Tags == nil {
+			element.Tags = []string{}
+		}
+		response = append(response, element)
+	}
+	writeJSONResponse(writer, response)
+}
+
+// *************Grafana annotation json stuff
+type GrafanaAnnotationRequest struct {
+	Range      Range             `json:"range"`
+	RangeRaw   Raw               `json:"rangeRaw"`
+	Annotation GrafanaAnnotation `json:"annotation"`
+}
+
+type GrafanaAnnotation struct {
+	Name       string          `json:"name"`
+	Datasource json.RawMessage `json:"datasource,omitempty"` // a name or a {type, uid} object depending on the grafana version
+	Enable     bool            `json:"enable"`
+	IconColor  string          `json:"iconColor,omitempty"`
+	Query      string          `json:"query"`
+}
+
+type GrafanaAnnotationResponseElement struct {
+	Annotation GrafanaAnnotation `json:"annotation"`
+	Time       int64             `json:"time"`
+	TimeEnd    int64             `json:"timeEnd,omitempty"`
+	IsRegion   bool              `json:"isRegion,omitempty"`
+	Title      string            `json:"title"`
+	Text       string            `json:"text"`
+	Tags       []string          `json:"tags"`
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Client is a caller of the API, loaded from the cfg/client folder. A client authenticates with its api key
+// (sent as the X-API-Key header or as Authorization: Bearer <key>) or with basic auth, the credentials are
+// Secrets so they can reference an environment variable or file
+type Client struct {
+	Name          string   `json:"name"`
+	APIKey        Secret   `json:"api_key"`
+	Username      Secret   `json:"username"`
+	Password      Secret   `json:"password"`
+	DataSelectors []string `json:"dataselectors"` // the dataselectors the client may use, empty is all of them
+	Roles         []string `json:"roles"`         // matched against the allowed_roles of dataselectors, variables and annotations
+	Admin         bool     `json:"admin"`         // may use the /admin, /status and /health endpoints
+}
+
+type clientContextKey struct{}
+
+// returns the client that made the request, nil if the request is anonymous (allow_anonymous is set)
+func clientFromContext(ctx context.Context) *Client {
+	client, _ := ctx.Value(clientContextKey{}).(*Client)
+	return client
+}
+
+// resolves the client's credentials
+func (c *Client) resolveSecrets() error {
+	var err error
+	c.APIKey, err = c.APIKey.resolve()
+	if err != nil {
+		return err
+	}
+	if c.Username != "" || c.Password != "" {
+		return resolveCredentials(&c.Username, &c.Password)
+	}
+	return nil
+}
+
+func secretEqual(a Secret, b string) bool {
+	return len(a) > 0 && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// returns the client whose credentials the request carries, found is false if the request has no (or
+// unknown) credentials
+func authenticateRequest(cfg *Config, r *http.Request) (*Client, bool) {
+	apiKey := r.Header.Get("X-API-Key")
+	if authorization := r.Header.Get("Authorization"); apiKey == "" && strings.HasPrefix(authorization, "Bearer ") {
+		apiKey = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	username, password, basicAuth := r.BasicAuth()
+
+	// every client is checked so the time taken doesn't give away which one matched
+	var match *Client
+	for _, client := range cfg.clientMap {
+		if apiKey != "" && secretEqual(client.APIKey, apiKey) {
+			match = client
+		}
+		if basicAuth && secretEqual(client.Username, username) && secretEqual(client.Password, password) {
+			match = client
+		}
+	}
+	return match, match != nil
+}
+
+// rejects requests without valid credentials with a 401, unless allowAnonymous is set in which case only
+// requests with invalid credentials are rejected. The client is added to the request's context
+func authMiddleware(allowAnonymous bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _, basicAuth := r.BasicAuth()
+			hasCredentials := basicAuth || r.Header.Get("X-API-Key") != "" ||
+				strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+			client, found := authenticateRequest(currentConfig(), r)
+			if !found && (hasCredentials || !allowAnonymous) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="dashboard"`)
+				http.Error(w, "Missing or invalid credentials", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), clientContextKey{}, client)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// rejects anonymous requests with a 401 and requests from clients that aren't admins with a 403, an
+// anonymous request is never an admin even if allow_anonymous is set
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientFromContext(r.Context())
+		if client == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dashboard"`)
+			http.Error(w, "Admin endpoints need the credentials of an admin client", http.StatusUnauthorized)
+			return
+		}
+		if !client.Admin {
+			http.Error(w, "Client "+client.Name+" is not an admin", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// returns if the client may use the dataselector, which it may if the dataselector is in the client's
+// dataselectors scope and the client is allowed by the dataselector's acl. An anonymous (nil) client may
+// only use the dataselectors every client may use, so dropping the credentials never gives more access
+func (c *Client) canAccessDataSelector(dSelector *DataSelector) bool {
+	if c == nil {
+		if !c.allowedBy(dSelector.AllowedClients, dSelector.AllowedRoles) {
+			return false
+		}
+		for _, client := range currentConfig().clientMap {
+			if !client.canAccessDataSelector(dSelector) {
+				return false
+			}
+		}
+		return true
+	}
+	return c.inScope(dSelector.Name) && c.allowedBy(dSelector.AllowedClients, dSelector.AllowedRoles)
+}
+
+// returns if the dataselector is in the client's dataselectors scope
+func (c *Client) inScope(dataSelectorName string) bool {
+	return len(c.DataSelectors) == 0 || containsString(c.DataSelectors, dataSelectorName)
+}
+
+// returns if the client is allowed by an acl of allowed_clients and allowed_roles. Both empty allows every
+// client, anonymous (nil) clients too, otherwise the client must be named or have one of the roles
+func (c *Client) allowedBy(allowedClients []string, allowedRoles []string) bool {
+	if len(allowedClients) == 0 && len(allowedRoles) == 0 {
+		return true
+	}
+	if c == nil {
+		return false
+	}
+	if containsString(allowedClients, c.Name) {
+		return true
+	}
+	for _, role := range c.Roles {
+		if containsString(allowedRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// returns a 403 http status code and error string if the request's client may not use the dataselector
+func checkDataSelectorAccess(ctx context.Context, dSelector *DataSelector) (int, string) {
+	if clientFromContext(ctx).canAccessDataSelector(dSelector) {
+		return http.StatusOK, ""
+	}
+	return accessDenied(ctx, "dataselector "+dSelector.Name)
+}
+
+// returns a 403 http status code and error string if the request's client isn't allowed by the acl of the
+// variable or annotation (what, e.g. "variable host")
+func checkACLAccess(ctx context.Context, what string, allowedClients []string, allowedRoles []string) (int, string) {
+	if clientFromContext(ctx).allowedBy(allowedClients, allowedRoles) {
+		return http.StatusOK, ""
+	}
+	return accessDenied(ctx, what)
+}
+
+func accessDenied(ctx context.Context, what string) (int, string) {
+	client := clientFromContext(ctx)
+	if client == nil {
+		return http.StatusForbidden, "Anonymous requests may not access " + what
+	}
+	return http.StatusForbidden, "Client " + client.Name + " may not access " + what
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAllowedBy(t *testing.T) {
+	ops := &Client{Name: "ops", Roles: []string{"oncall"}}
+	teamA := &Client{Name: "team-a", Roles: []string{"dev"}}
+
+	tests := []struct {
+		name           string
+		client         *Client
+		allowedClients []string
+		allowedRoles   []string
+		want           bool
+	}{
+		{"no acl", teamA, nil, nil, true},
+		{"no acl anonymous", nil, nil, nil, true},
+		{"named client", teamA, []string{"team-a"}, nil, true},
+		{"other client", ops, []string{"team-a"}, nil, false},
+		{"role", ops, nil, []string{"oncall"}, true},
+		{"other role", teamA, nil, []string{"oncall"}, false},
+		{"named or role", teamA, []string{"team-a"}, []string{"oncall"}, true},
+		{"anonymous with an acl", nil, nil, []string{"oncall"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.client.allowedBy(test.allowedClients, test.allowedRoles); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVariableAndAnnotationACLs(t *testing.T) {
+	cfgRoot := newTestCfg(t)
+	writeTestCfg(t, cfgRoot, map[string]string{
+		"client/ops.json":        `{"name": "ops", "api_key": "k1", "roles": ["oncall"]}`,
+		"client/team-a.json":     `{"name": "team-a", "api_key": "k2"}`,
+		"variable/open.json":     `{"name": "open", "query_name": "q"}`,
+		"variable/host.json":     `{"name": "host", "query_name": "q", "allowed_roles": ["oncall"]}`,
+		"annotation/deploy.json": `{"name": "deploy", "query_name": "q", "time_column_header": "v", "allowed_clients": ["ops"]}`,
+	})
+	defer loadTestCfg(t, cfgRoot)()
+	cfg := currentConfig()
+
+	opsCtx := context.WithValue(context.Background(), clientContextKey{}, cfg.clientMap["ops"])
+	teamACtx := context.WithValue(context.Background(), clientContextKey{}, cfg.clientMap["team-a"])
+	params := defaultQueryParameters()
+
+	if _, httpCode, errorString := getVariableValues(teamACtx, "host", params); httpCode != http.StatusForbidden {
+		t.Fatalf("client without the role got %d %q for the variable, want 403", httpCode, errorString)
+	}
+	if _, httpCode, errorString := getVariableValues(context.Background(), "host", params); httpCode != http.StatusForbidden {
+		t.Fatalf("anonymous request got %d %q for the variable, want 403", httpCode, errorString)
+	}
+	if _, _, errorString := getVariableValues(opsCtx, "host", params); errorString != "" {
+		t.Fatalf("client with the role got %q for the variable", errorString)
+	}
+	if _, _, errorString := getVariableValues(teamACtx, "open", params); errorString != "" {
+		t.Fatalf("variable without an acl got %q", errorString)
+	}
+	if _, httpCode, errorString := getAnnotationEvents(teamACtx, "deploy", params); httpCode != http.StatusForbidden {
+		t.Fatalf("client not allowed got %d %q for the annotation, want 403", httpCode, errorString)
+	}
+	if _, _, errorString := getAnnotationEvents(opsCtx, "deploy", params); errorString != "" {
+		t.Fatalf("allowed client got %q for the annotation", errorString)
+	}
+}
+
+func TestUnknownAllowedClientsAreProblems(t *testing.T) {
+	cfgRoot := newTestCfg(t)
+	defer loadTestCfg(t, cfgRoot)()
+	writeTestCfg(t, cfgRoot, map[string]string{
+		"variable/host.json":     `{"name": "host", "query_name": "q", "allowed_clients": ["nobody"]}`,
+		"annotation/deploy.json": `{"name": "deploy", "query_name": "q", "time_column_header": "v", "allowed_clients": ["nobody"]}`,
+	})
+
+	_, problems, err := loadConfig(cfgRoot, currentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]bool)
+	for _, problem := range problems {
+		if problem.Field == "allowed_clients[0]" {
+			files[problem.File] = true
+		}
+	}
+	if len(files) != 2 {
+		t.Fatalf("got problems %v, want the unknown client of the variable and the annotation", problems)
+	}
+}
+
+func TestAnonymousRequestsGetNoMoreThanEveryClient(t *testing.T) {
+	cfgRoot := newTestCfg(t)
+	writeTestCfg(t, cfgRoot, map[string]string{
+		"client/admin.json":    `{"name": "admin", "api_key": "k1", "admin": true}`,
+		"client/team-a.json":   `{"name": "team-a", "api_key": "k2", "dataselectors": ["dq"]}`,
+		"dataselector/ds.json": `{"name": "ds", "query_name": "q", "allowed_clients": ["admin"]}`,
+	})
+	defer loadTestCfg(t, cfgRoot)()
+	serverCfg := defaultServerConfig()
+	serverCfg.AllowAnonymous = true
+	router := registerRoutes(serverCfg)
+
+	requests := []struct {
+		method string
+		path   string
+		apiKey string
+		want   int
+	}{
+		{http.MethodGet, "/status/query", "k2", http.StatusForbidden},
+		{http.MethodGet, "/status/query", "", http.StatusUnauthorized},
+		{http.MethodPost, "/admin/reload", "", http.StatusUnauthorized},
+		{http.MethodGet, "/status/query", "k1", http.StatusOK},
+		{http.MethodGet, "/dataselector/dr", "k2", http.StatusForbidden},
+		{http.MethodGet, "/dataselector/dr", "", http.StatusForbidden},
+		{http.MethodGet, "/dataselector/dr", "k1", http.StatusOK},
+		{http.MethodGet, "/dataselector/ds", "", http.StatusForbidden},
+		{http.MethodGet, "/dataselector/dq", "", http.StatusOK},
+	}
+	for _, request := range requests {
+		r := httptest.NewRequest(request.method, request.path, nil)
+		if request.apiKey != "" {
+			r.Header.Set("X-API-Key", request.apiKey)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, r)
+		if recorder.Code != request.want {
+			t.Errorf("%s %s with key %q got %d, want %d", request.method, request.path, request.apiKey, recorder.Code, request.want)
+		}
+	}
+}
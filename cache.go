@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the most parameter sets a single query keeps results for, the least recently used is dropped after that
+const maxCachedParameterSetsPerQuery = 32
+
+// QueryCacheEntry is the cached result of a query for one set of query parameters. The datablock is an
+// immutable snapshot, a refresh swaps in a new one and never modifies the old, so a reader can keep using
+// the datablock it got without any locking (and must not modify it)
+type QueryCacheEntry struct {
+	params QueryParameters // the parameters the entry is refreshed with, set when the entry is created
+
+	lock            sync.Mutex // guards everything below
+	lastAccessTime  time.Time
+	datablock       *Datablock   // nil until the first successful refresh
+	refreshing      *refreshCall // the refresh currently running, nil if none
+	lastRunTime     time.Time
+	lastDuration    time.Duration
+	lastError       error
+	lastSuccessTime time.Time
+	nextRefreshTime time.Time
+}
+
+// refreshCall is one run of an entry's query, shared by everyone asking for a refresh while it runs
+type refreshCall struct {
+	done      chan struct{} // closed once datablock and err are set
+	datablock *Datablock
+	err       error
+	waiters   int                // callers still waiting for the result, guarded by the entry's lock
+	abandoned bool               // every waiter gave up, guarded by the entry's lock
+	cancel    context.CancelFunc // cancels the run, called when the last waiter gives up
+}
+
+// returns the cache entry for the key, creating it for the parameters (and evicting the least recently used
+// entry if full) if needed
+func (v *Query) cacheEntry(key string, params QueryParameters) *QueryCacheEntry {
+	v.cacheLock.Lock()
+	defer v.cacheLock.Unlock()
+
+	if v.cache == nil {
+		v.cache = make(map[string]*QueryCacheEntry)
+	}
+
+	entry, found := v.cache[key]
+	if !found {
+		if len(v.cache) >= maxCachedParameterSetsPerQuery {
+			oldestKey := ""
+			var oldestAccess time.Time
+			for k, e := range v.cache {
+				lastAccessTime := e.accessTime()
+				if oldestAccess.IsZero() || lastAccessTime.Before(oldestAccess) {
+					oldestKey = k
+					oldestAccess = lastAccessTime
+				}
+			}
+			delete(v.cache, oldestKey)
+		}
+		entry = &QueryCacheEntry{params: params}
+		v.cache[key] = entry
+	}
+
+	entry.lock.Lock()
+	entry.lastAccessTime = time.Now()
+	entry.lock.Unlock()
+	return entry
+}
+
+// returns the query's cache entries by key
+func (v *Query) cacheEntries() map[string]*QueryCacheEntry {
+	v.cacheLock.Lock()
+	defer v.cacheLock.Unlock()
+
+	entries := make(map[string]*QueryCacheEntry, len(v.cache))
+	for key, entry := range v.cache {
+		entries[key] = entry
+	}
+	return entries
+}
+
+// creates the cache entry of a query without parameters the first time it is called, so the query is
+// loaded before the first request. Once the entry goes idle and is dropped the next request loads it again
+func (v *Query) preloadCacheEntry(key string, params QueryParameters) {
+	v.cacheLock.Lock()
+	preloaded := v.preloaded
+	v.preloaded = true
+	v.cacheLock.Unlock()
+
+	if !preloaded {
+		v.cacheEntry(key, params)
+	}
+}
+
+// drops the cache entries that haven't been requested within the timeout, so they stop being refreshed
+func (v *Query) removeIdleCacheEntries(timeout time.Duration) {
+	v.cacheLock.Lock()
+	defer v.cacheLock.Unlock()
+
+	for key, entry := range v.cache {
+		if time.Since(entry.accessTime()) > timeout {
+			delete(v.cache, key)
+		}
+	}
+}
+
+func (e *QueryCacheEntry) accessTime() time.Time {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.lastAccessTime
+}
+
+// returns the current datablock snapshot (nil if the entry has never been loaded) and the status of the
+// latest refresh, the snapshot is stale if that refresh failed
+func (e *QueryCacheEntry) snapshot() (*Datablock, RefreshStatus) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	refreshStatus := RefreshStatus{LastSuccessTime: e.lastSuccessTime}
+	if e.lastError != nil {
+		refreshStatus.Stale = true
+		refreshStatus.LastError = e.lastError.Error()
+	}
+	return e.datablock, refreshStatus
+}
+
+// returns if the entry's next refresh time has passed and no refresh is running
+func (e *QueryCacheEntry) isDue(now time.Time) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.refreshing == nil && !now.Before(e.nextRefreshTime)
+}
+
+// runs the query for the entry and returns the new datablock. If a refresh is already running this waits
+// for it and returns its result instead of starting another, so nobody is handed the old datablock while
+// a new one is being loaded. The context only bounds the caller's wait, the run itself is cancelled when
+// every caller waiting for it has given up or when the query's timeout is reached
+func (e *QueryCacheEntry) refresh(ctx context.Context, db *Database, v *Query) (*Datablock, error) {
+	e.lock.Lock()
+	call := e.refreshing
+	if call == nil {
+		if !db.startRefresh() {
+			e.lock.Unlock()
+			return nil, errors.New("database " + db.Name + " was removed by a config reload")
+		}
+		runCtx, cancel := context.WithCancel(context.Background())
+		call = &refreshCall{done: make(chan struct{}), cancel: cancel}
+		e.refreshing = call
+		go e.runRefresh(runCtx, call, db, v)
+	}
+	call.waiters++
+	e.lock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.datablock, call.err
+	case <-ctx.Done():
+		e.lock.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			call.abandoned = true
+			// let the next caller start a new run rather than join the cancelled one
+			if e.refreshing == call {
+				e.refreshing = nil
+			}
+		}
+		e.lock.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// waits for a free refresh slot on the database, runs the query with the query's timeout and stores the
+// result and run status in the entry. A failed run keeps the previous datablock, an abandoned run stores
+// nothing as a newer run may already have replaced it. This runs outside the request's goroutine (and its
+// panic recovery) so a panic in the run (e.g. in a driver) is recovered here and is the run's error
+func (e *QueryCacheEntry) runRefresh(ctx context.Context, call *refreshCall, db *Database, v *Query) {
+	defer db.finishRefresh()
+	defer call.cancel()
+
+	var datablock Datablock
+	var err error
+	var startTime time.Time
+	var duration time.Duration
+
+	// the waiters are released however the run ends, or they would wait until their contexts time out
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("query refresh panicked: %v", recovered)
+			if !startTime.IsZero() {
+				duration = time.Since(startTime)
+			}
+			logger.WithFields(logrus.Fields{
+				"query":    v.Name,
+				"database": db.Name,
+				"panic":    recovered,
+				"stack":    string(debug.Stack()),
+			}).Error("Query refresh panicked")
+			observeQueryRefresh(v.Name, duration, 0, err)
+		}
+
+		e.lock.Lock()
+		if !call.abandoned {
+			e.lastRunTime = startTime
+			e.lastDuration = duration
+			e.lastError = err
+			if err == nil {
+				e.lastSuccessTime = time.Now()
+				datablock.LastSuccessTime = e.lastSuccessTime
+				e.datablock = &datablock
+				call.datablock = e.datablock
+			}
+			e.nextRefreshTime = nextRefreshTime(v.refreshInterval())
+			e.refreshing = nil
+		}
+		call.err = err
+		e.lock.Unlock()
+
+		close(call.done)
+	}()
+
+	params := e.params
+	params.TimeRange = params.TimeRange.movedToNow()
+
+	select {
+	case db.refreshSlots <- struct{}{}:
+		func() {
+			defer func() { <-db.refreshSlots }()
+			queryCtx, cancel := context.WithTimeout(ctx, v.timeout())
+			defer cancel()
+			startTime = time.Now()
+			datablock, err = runQuery(queryCtx, db, v, params)
+			err = redactError(err, db.secrets...)
+			duration = time.Since(startTime)
+		}()
+		observeQueryRefresh(v.Name, duration, len(datablock.Rowdata), err)
+		logQueryRefresh(db, v, duration, len(datablock.Rowdata), err)
+	case <-ctx.Done():
+		startTime = time.Now()
+		err = ctx.Err()
+	}
+}
+
+// logs a run of a query, rows is only used if the run succeeded
+func logQueryRefresh(db *Database, v *Query, duration time.Duration, rows int, err error) {
+	entry := logger.WithFields(logrus.Fields{
+		"query":       v.Name,
+		"database":    db.Name,
+		"duration_ms": duration.Milliseconds(),
+	})
+	if err != nil {
+		entry.WithError(err).Warn("Query refresh failed")
+		return
+	}
+	entry.WithField("rows", rows).Info("Query refreshed")
+}
+
+func (e *QueryCacheEntry) status(key string) QueryCacheEntryStatus {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	entryStatus := QueryCacheEntryStatus{
+		Key:             key,
+		Running:         e.refreshing != nil,
+		LastRunTime:     e.lastRunTime,
+		LastDurationMS:  int64(e.lastDuration / time.Millisecond),
+		LastSuccessTime: e.lastSuccessTime,
+		NextRefreshTime: e.nextRefreshTime,
+	}
+	if e.datablock != nil {
+		entryStatus.RowCount = len(e.datablock.Rowdata)
+	}
+	if e.lastError != nil {
+		entryStatus.LastError = e.lastError.Error()
+	}
+	return entryStatus
+}
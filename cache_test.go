@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingConnector is a database/sql driver whose queries block until released (or their context is
+// cancelled), so a test can hold a refresh in flight while it joins, cancels and reads
+type blockingConnector struct {
+	lock    sync.Mutex
+	runs    int
+	started chan struct{} // gets a value when a query starts
+	release chan struct{} // closed to let the queries return their row
+	panics  bool          // the queries panic instead of blocking
+}
+
+func newBlockingConnector() *blockingConnector {
+	return &blockingConnector{started: make(chan struct{}, 16), release: make(chan struct{})}
+}
+
+func (c *blockingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return blockingConn{connector: c}, nil
+}
+
+func (c *blockingConnector) Driver() driver.Driver {
+	return nil
+}
+
+func (c *blockingConnector) runCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.runs
+}
+
+type blockingConn struct {
+	connector *blockingConnector
+}
+
+func (conn blockingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (conn blockingConn) Close() error {
+	return nil
+}
+
+func (conn blockingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+func (conn blockingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c := conn.connector
+	c.lock.Lock()
+	c.runs++
+	run := c.runs
+	panics := c.panics
+	c.lock.Unlock()
+	if panics {
+		panic("driver bug")
+	}
+	c.started <- struct{}{}
+
+	select {
+	case <-c.release:
+		return &blockingRows{values: [][]driver.Value{{"a", int64(run)}}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type blockingRows struct {
+	values [][]driver.Value
+}
+
+func (rows *blockingRows) Columns() []string {
+	return []string{"name", "v"}
+}
+
+func (rows *blockingRows) Close() error {
+	return nil
+}
+
+func (rows *blockingRows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.values[0])
+	rows.values = rows.values[1:]
+	return nil
+}
+
+// returns a database and query backed by a blocking connector
+func newBlockingDatabase(connector *blockingConnector) (*Database, *Query) {
+	db := &Database{
+		Name:         "test",
+		DBType:       "sqlite",
+		DB:           sql.OpenDB(connector),
+		refreshSlots: make(chan struct{}, 1),
+	}
+	query := &Query{Name: "test", DatabaseName: "test", QueryString: "select name, v from t", RefreshTime: 60,
+		ColumnList: []string{"name", "v"}}
+	return db, query
+}
+
+// waits until the refresh running on the entry has the number of waiters
+func waitForWaiters(t *testing.T, entry *QueryCacheEntry, waiters int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		entry.lock.Lock()
+		joined := entry.refreshing != nil && entry.refreshing.waiters == waiters
+		entry.lock.Unlock()
+		if joined {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("refresh never had %d waiters", waiters)
+}
+
+func waitForStart(t *testing.T, connector *blockingConnector) {
+	select {
+	case <-connector.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("query never started")
+	}
+}
+
+func TestRefreshCoalescesWaiters(t *testing.T) {
+	connector := newBlockingConnector()
+	db, query := newBlockingDatabase(connector)
+	defer db.DB.Close()
+	entry := &QueryCacheEntry{params: defaultQueryParameters()}
+
+	const waiters = 8
+	results := make([]*Datablock, waiters)
+	errs := make([]error, waiters)
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = entry.refresh(context.Background(), db, query)
+		}(i)
+	}
+	waitForStart(t, connector)
+	waitForWaiters(t, entry, waiters)
+	close(connector.release)
+	wg.Wait()
+
+	if runs := connector.runCount(); runs != 1 {
+		t.Fatalf("query ran %d times, want 1", runs)
+	}
+	for i := 0; i < waiters; i++ {
+		if errs[i] != nil {
+			t.Fatalf("waiter %d: %v", i, errs[i])
+		}
+		if results[i] != results[0] {
+			t.Fatalf("waiter %d got a different datablock than waiter 0", i)
+		}
+	}
+	if snapshot, _ := entry.snapshot(); snapshot != results[0] {
+		t.Fatal("entry doesn't hold the refreshed datablock")
+	}
+}
+
+func TestRefreshAbandonedWhenEveryWaiterCancels(t *testing.T) {
+	connector := newBlockingConnector()
+	db, query := newBlockingDatabase(connector)
+	defer db.DB.Close()
+	entry := &QueryCacheEntry{params: defaultQueryParameters()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := entry.refresh(ctx, db, query)
+		done <- err
+	}()
+	waitForStart(t, connector)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("cancelled waiter got %v, want context.Canceled", err)
+	}
+
+	// the abandoned run is cancelled and leaves the entry alone, the next refresh starts a new run
+	close(connector.release)
+	datablock, err := entry.refresh(context.Background(), db, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs := connector.runCount(); runs != 2 {
+		t.Fatalf("query ran %d times, want 2", runs)
+	}
+	if got := datablock.Rowdata[1][1]; got != int64(2) {
+		t.Fatalf("got the result of run %v, want run 2", got)
+	}
+	if snapshot, status := entry.snapshot(); snapshot != datablock || status.Stale {
+		t.Fatalf("entry holds %p (stale %v), want the second run's datablock", snapshot, status.Stale)
+	}
+}
+
+func TestRefreshContinuesWhenSomeWaitersCancel(t *testing.T) {
+	connector := newBlockingConnector()
+	db, query := newBlockingDatabase(connector)
+	defer db.DB.Close()
+	entry := &QueryCacheEntry{params: defaultQueryParameters()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := entry.refresh(ctx, db, query)
+		cancelled <- err
+	}()
+	waited := make(chan error)
+	var datablock *Datablock
+	go func() {
+		var err error
+		datablock, err = entry.refresh(context.Background(), db, query)
+		waited <- err
+	}()
+	waitForStart(t, connector)
+	waitForWaiters(t, entry, 2)
+
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Fatalf("cancelled waiter got %v, want context.Canceled", err)
+	}
+	close(connector.release)
+	if err := <-waited; err != nil {
+		t.Fatalf("remaining waiter got %v", err)
+	}
+	if runs := connector.runCount(); runs != 1 || datablock == nil {
+		t.Fatalf("query ran %d times (datablock %v), want 1 run shared by the remaining waiter", runs, datablock)
+	}
+}
+
+func TestSnapshotReadsDuringRefresh(t *testing.T) {
+	connector := newBlockingConnector()
+	db, query := newBlockingDatabase(connector)
+	defer db.DB.Close()
+	entry := &QueryCacheEntry{params: defaultQueryParameters()}
+	previous := &Datablock{Title: "previous", Rowdata: map[int][]interface{}{1: {"a", int64(0)}}}
+	entry.datablock = previous
+
+	refreshed := make(chan *Datablock)
+	go func() {
+		datablock, _ := entry.refresh(context.Background(), db, query)
+		refreshed <- datablock
+	}()
+	waitForStart(t, connector)
+
+	// readers keep getting the previous snapshot while the refresh runs and the new one once it is done
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				snapshot, _ := entry.snapshot()
+				if len(snapshot.Rowdata) != 1 || snapshot.Rowdata[1][0] != "a" {
+					t.Errorf("read an inconsistent snapshot %v", snapshot.Rowdata)
+					return
+				}
+				entry.status("")
+				entry.isDue(time.Now())
+			}
+		}()
+	}
+	close(connector.release)
+	datablock := <-refreshed
+	close(stop)
+	wg.Wait()
+
+	if snapshot, _ := entry.snapshot(); snapshot != datablock || snapshot == previous {
+		t.Fatal("entry doesn't hold the refreshed datablock")
+	}
+	if previous.Title != "previous" || previous.Rowdata[1][1] != int64(0) {
+		t.Fatal("the refresh modified the previous snapshot")
+	}
+}
+
+func TestRefreshRecoversPanics(t *testing.T) {
+	connector := newBlockingConnector()
+	connector.panics = true
+	db, query := newBlockingDatabase(connector)
+	defer db.DB.Close()
+	entry := &QueryCacheEntry{params: defaultQueryParameters()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := entry.refresh(ctx, db, query); err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Fatalf("refresh of a panicking query got %v, want the panic as the error", err)
+	}
+	if _, status := entry.snapshot(); !status.Stale {
+		t.Fatal("the panic wasn't stored as the entry's last error")
+	}
+
+	// the entry and the database's refresh slot are free for the next run
+	connector.lock.Lock()
+	connector.panics = false
+	connector.lock.Unlock()
+	close(connector.release)
+	if _, err := entry.refresh(ctx, db, query); err != nil {
+		t.Fatalf("refresh after the panic: %v", err)
+	}
+}
+
+func TestRemovedDatabaseClosesOnceRefreshesFinish(t *testing.T) {
+	connector := newBlockingConnector()
+	db, query := newBlockingDatabase(connector)
+	entry := &QueryCacheEntry{params: defaultQueryParameters()}
+
+	refreshed := make(chan error)
+	go func() {
+		_, err := entry.refresh(context.Background(), db, query)
+		refreshed <- err
+	}()
+	waitForStart(t, connector)
+
+	// a reload removes the database while its query runs, the run finishes on the open database
+	db.closeWhenIdle()
+	if err := db.DB.Ping(); err != nil {
+		t.Fatalf("database closed while a refresh was running: %v", err)
+	}
+	close(connector.release)
+	if err := <-refreshed; err != nil {
+		t.Fatalf("refresh running when the database was removed: %v", err)
+	}
+	// the run's waiters are released just before the run counts itself finished
+	deadline := time.Now().Add(5 * time.Second)
+	for db.DB.Ping() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("database wasn't closed once its refresh finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	other := &QueryCacheEntry{params: defaultQueryParameters()}
+	if _, err := other.refresh(context.Background(), db, query); err == nil || !strings.Contains(err.Error(), "removed") {
+		t.Fatalf("refresh on a removed database got %v", err)
+	}
+}
+
+func TestRemovedIdleDatabaseClosesNow(t *testing.T) {
+	db, _ := newBlockingDatabase(newBlockingConnector())
+	db.closeWhenIdle()
+	if err := db.DB.Ping(); err == nil {
+		t.Fatal("idle database wasn't closed")
+	}
+	db.closeWhenIdle()
+}
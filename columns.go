@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the column types of a datablock, named as grafana's table columns
+const (
+	columnTypeNumber = "number"
+	columnTypeTime   = "time"
+	columnTypeString = "string"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// the type of a result column from what the driver reports about it. The scan type is checked first, the
+// database type name is for drivers that scan everything into []byte or string (e.g. mysql DECIMAL and
+// oracle NUMBER)
+func columnTypeFromSQL(sqlColumnType *sql.ColumnType) string {
+	if scanType := sqlColumnType.ScanType(); scanType != nil {
+		for scanType.Kind() == reflect.Ptr {
+			scanType = scanType.Elem()
+		}
+		if scanType == timeType || scanType.ConvertibleTo(timeType) {
+			return columnTypeTime
+		}
+		switch scanType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return columnTypeNumber
+		}
+		// sql.NullTime, sql.NullInt64 etc
+		if scanType.Kind() == reflect.Struct {
+			if field, found := scanType.FieldByName("Time"); found && field.Type == timeType {
+				return columnTypeTime
+			}
+			for _, name := range []string{"Int64", "Int32", "Float64"} {
+				if _, found := scanType.FieldByName(name); found {
+					return columnTypeNumber
+				}
+			}
+		}
+	}
+
+	// the first word without a size e.g. NUMBER(10,2) or TIMESTAMP WITH TIME ZONE
+	typeName := strings.ToUpper(sqlColumnType.DatabaseTypeName())
+	if end := strings.IndexAny(typeName, " ("); end != -1 {
+		typeName = typeName[:end]
+	}
+	if columnType, found := databaseTypeNameColumnTypes[typeName]; found {
+		return columnType
+	}
+	return columnTypeString
+}
+
+// the column types of the database type names (as reported by the drivers) that are numbers or times
+var databaseTypeNameColumnTypes = map[string]string{
+	"INT": columnTypeNumber, "INTEGER": columnTypeNumber, "TINYINT": columnTypeNumber, "SMALLINT": columnTypeNumber,
+	"MEDIUMINT": columnTypeNumber, "BIGINT": columnTypeNumber, "INT2": columnTypeNumber, "INT4": columnTypeNumber,
+	"INT8": columnTypeNumber, "UNSIGNED": columnTypeNumber, "DECIMAL": columnTypeNumber, "NUMERIC": columnTypeNumber,
+	"NUMBER": columnTypeNumber, "FLOAT": columnTypeNumber, "FLOAT4": columnTypeNumber, "FLOAT8": columnTypeNumber,
+	"DOUBLE": columnTypeNumber, "REAL": columnTypeNumber, "MONEY": columnTypeNumber, "SMALLMONEY": columnTypeNumber,
+	"BINARY_FLOAT": columnTypeNumber, "BINARY_DOUBLE": columnTypeNumber,
+	"DATE": columnTypeTime, "DATETIME": columnTypeTime, "DATETIME2": columnTypeTime, "SMALLDATETIME": columnTypeTime,
+	"DATETIMEOFFSET": columnTypeTime, "TIMESTAMP": columnTypeTime, "TIMESTAMPTZ": columnTypeTime,
+}
+
+// the type of a column from one of its values, for datablocks without column types
+func columnTypeOfValue(value interface{}) string {
+	switch value.(type) {
+	case time.Time:
+		return columnTypeTime
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return columnTypeNumber
+	}
+	return columnTypeString
+}
+
+// converts a scanned value to a plain json friendly value: []byte is a string (instead of base64 in json),
+// the values of number columns that the driver scans as text (decimals) are numbers and the values of time
+// columns scanned as text are times. Times are kept as time.Time for the rules, they are converted to epoch
+// ms in the grafana responses
+func normalizeValue(value interface{}, columnType string) interface{} {
+	if bytesValue, ok := value.([]byte); ok {
+		value = string(bytesValue)
+	}
+	// e.g. sqlite DATETIME text or mysql without parseTime
+	if textValue, ok := value.(string); ok && columnType == columnTypeTime {
+		if timeValue, ok := timeFromValue(textValue); ok {
+			return timeValue
+		}
+		return value
+	}
+	if columnType != columnTypeNumber || value == nil {
+		return value
+	}
+
+	reflectValue := reflect.ValueOf(value)
+	if reflectValue.Kind() != reflect.String {
+		return value
+	}
+	text := strings.TrimSpace(reflectValue.String())
+	if intValue, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return intValue
+	}
+	if floatValue, err := strconv.ParseFloat(text, 64); err == nil {
+		return floatValue
+	}
+	return value
+}
+
+// returns the type of the datablock's column, inferred from the column's first non nil value if the
+// datablock has no column types
+func (datablock Datablock) columnType(columnIndex int) string {
+	if columnIndex < len(datablock.ColumnTypes) && datablock.ColumnTypes[columnIndex] != "" {
+		return datablock.ColumnTypes[columnIndex]
+	}
+	for _, k := range sortedKeysForDataBlockData(datablock.Rowdata) {
+		row := datablock.Rowdata[k]
+		if columnIndex < len(row) && row[columnIndex] != nil {
+			return columnTypeOfValue(row[columnIndex])
+		}
+	}
+	return columnTypeString
+}
+
+// returns the types of the datablock's columns at the indexes, for rules building a datablock from some of
+// the columns of another. Nil if the datablock has no column types
+func (datablock Datablock) columnTypesFor(columnIndexes ...int) []string {
+	if len(datablock.ColumnTypes) == 0 {
+		return nil
+	}
+	columnTypes := make([]string, len(columnIndexes))
+	for i, columnIndex := range columnIndexes {
+		if columnIndex < len(datablock.ColumnTypes) {
+			columnTypes[i] = datablock.ColumnTypes[columnIndex]
+		}
+	}
+	return columnTypes
+}
+
+// the layouts databases write times as text in, the time zone is utc if the layout has none
+var databaseTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// the time of a value that is a time, epoch ms, a RFC3339 string or a string in one of the database time
+// layouts. False if it is none of them (e.g. nil)
+func timeFromValue(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case int64:
+		return time.Unix(0, v*int64(time.Millisecond)), true
+	case float64:
+		return time.Unix(0, int64(v)*int64(time.Millisecond)), true
+	case string:
+		text := strings.TrimSpace(v)
+		if timeValue, err := parseTimeValue(text); err == nil {
+			return timeValue, true
+		}
+		for _, layout := range databaseTimeLayouts {
+			if timeValue, err := time.Parse(layout, text); err == nil {
+				return timeValue, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// the value as grafana expects it in a table row, times are epoch ms
+func grafanaTableValue(value interface{}) interface{} {
+	if timeValue, ok := value.(time.Time); ok {
+		return timeValue.UnixNano() / int64(time.Millisecond)
+	}
+	return value
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeValue(t *testing.T) {
+	at := time.Date(2026, 10, 17, 1, 2, 3, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		value      interface{}
+		columnType string
+		want       interface{}
+	}{
+		{"bytes are strings", []byte("abc"), columnTypeString, "abc"},
+		{"integer text", []byte("42"), columnTypeNumber, int64(42)},
+		{"decimal text", "12.50", columnTypeNumber, 12.5},
+		{"text in a number column", "n/a", columnTypeNumber, "n/a"},
+		{"nil number", nil, columnTypeNumber, nil},
+		{"time", at, columnTypeTime, at},
+		{"sqlite datetime text", "2026-10-17 01:02:03", columnTypeTime, at},
+		{"mysql datetime bytes", []byte("2026-10-17 01:02:03"), columnTypeTime, at},
+		{"rfc3339 text", "2026-10-17T01:02:03Z", columnTypeTime, at},
+		{"date text", "2026-10-17", columnTypeTime, time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)},
+		{"unparsable time text", "soon", columnTypeTime, "soon"},
+		{"nil time", nil, columnTypeTime, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := normalizeValue(test.value, test.columnType)
+			if gotTime, ok := got.(time.Time); ok {
+				if wantTime, ok := test.want.(time.Time); !ok || !gotTime.Equal(wantTime) {
+					t.Fatalf("got %v, want %v", got, test.want)
+				}
+				return
+			}
+			if got != test.want {
+				t.Fatalf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
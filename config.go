@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cfgFolderDB           = "db"
+	cfgFolderQuery        = "query"
+	cfgFolderDataSelector = "dataselector"
+	cfgFolderVariable     = "variable"
+	cfgFolderAnnotation   = "annotation"
+	cfgFolderClient       = "client"
+)
+
+// how often the cfg folders are checked for changes. The folders are polled rather than watched with
+// inotify as file events are not passed through for docker volumes mounted from a windows/mac host
+const cfgWatchInterval = 5 * time.Second
+
+// Config is one load of the cfg folders. It is not modified once loaded, a reload builds a new Config
+// and swaps it in, so anything holding the Config of a request sees a consistent set of maps
+type Config struct {
+	cfgRoot                string // the folder the config was loaded from
+	dbMap                  map[string]*Database
+	queryMap               map[string]*Query
+	dataSelectorMap        map[string]*DataSelector
+	dataSelectorToQueryMap map[string]*Query
+	variableMap            map[string]*Variable
+	annotationMap          map[string]*Annotation
+	clientMap              map[string]*Client
+}
+
+// ConfigProblem is something wrong with a cfg file, the file's entry is skipped (or the reload refused)
+// Field is the json field of the file the problem is about, empty if it is about the whole file
+type ConfigProblem struct {
+	File    string `json:"file"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p ConfigProblem) String() string {
+	if p.Field == "" {
+		return p.File + ": " + p.Message
+	}
+	return p.File + ": " + p.Field + ": " + p.Message
+}
+
+var cfgLock sync.RWMutex
+var loadedCfg = newConfig()
+
+// serializes reloads from the watcher and the admin endpoint
+var reloadLock sync.Mutex
+
+func newConfig() *Config {
+	return &Config{
+		dbMap:                  make(map[string]*Database),
+		queryMap:               make(map[string]*Query),
+		dataSelectorMap:        make(map[string]*DataSelector),
+		dataSelectorToQueryMap: make(map[string]*Query),
+		variableMap:            make(map[string]*Variable),
+		annotationMap:          make(map[string]*Annotation),
+		clientMap:              make(map[string]*Client),
+	}
+}
+
+// returns the currently loaded config
+func currentConfig() *Config {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return loadedCfg
+}
+
+func setCurrentConfig(cfg *Config) {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	loadedCfg = cfg
+}
+
+// reads the json files of a cfg folder, returned in file name order
+// a missing optional folder is the same as an empty one
+func readCfgFolder(cfgRoot string, folder string, optional bool) (map[string][]byte, []string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(cfgRoot, folder))
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	contents := make(map[string][]byte)
+	var paths []string
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		path := filepath.Join(cfgRoot, folder, file.Name())
+		jsonData, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		contents[path] = jsonData
+		paths = append(paths, path)
+	}
+	return contents, paths, nil
+}
+
+// loads the cfg folders into a new Config. Databases and queries whose definition is the same as in the
+// previous config are carried over (keeping their open connections and cached results), previous can be nil.
+// Entries with problems are left out of the config and reported, the error is for folders that can't be read
+func loadConfig(cfgRoot string, previous *Config) (*Config, []ConfigProblem, error) {
+	if previous == nil {
+		previous = newConfig()
+	}
+	cfg := newConfig()
+	cfg.cfgRoot = cfgRoot
+	var problems []ConfigProblem
+
+	// use the db json files and create the different sql.Db into the dbMap
+	dbFiles, dbPaths, err := readCfgFolder(cfgRoot, cfgFolderDB, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, path := range dbPaths {
+		jsonData := dbFiles[path]
+
+		var genericDB DbConfig
+		err := json.Unmarshal(jsonData, &genericDB)
+		if err != nil {
+			problems = append(problems, jsonConfigProblem(path, jsonData, err))
+			continue
+		}
+		if genericDB.Name == "" {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Missing database name"})
+			continue
+		}
+		if _, found := cfg.dbMap[genericDB.Name]; found {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Duplicate database name " + genericDB.Name})
+			continue
+		}
+
+		previousDB, found := previous.dbMap[genericDB.Name]
+		if found && bytes.Equal(previousDB.configJSON, jsonData) {
+			cfg.dbMap[genericDB.Name] = previousDB
+			continue
+		}
+
+		database, err := openDatabase(genericDB, jsonData)
+		if err != nil {
+			problems = append(problems, jsonConfigProblem(path, jsonData, err))
+			continue
+		}
+		cfg.dbMap[database.Name] = database
+	}
+
+	// read the cfg/query folder and load all the query json files
+	queryFiles, queryPaths, err := readCfgFolder(cfgRoot, cfgFolderQuery, false)
+	if err != nil {
+		closeUnusedDatabases(cfg, previous)
+		return nil, nil, err
+	}
+	for _, path := range queryPaths {
+		var query Query
+		err := json.Unmarshal(queryFiles[path], &query)
+		if err != nil {
+			problems = append(problems, jsonConfigProblem(path, queryFiles[path], err))
+			continue
+		}
+		if query.Name == "" {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Missing query name"})
+			continue
+		}
+		if _, found := cfg.queryMap[query.Name]; found {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Duplicate query name " + query.Name})
+			continue
+		}
+		if _, found := cfg.dbMap[query.DatabaseName]; !found {
+			problems = append(problems, ConfigProblem{File: path, Field: "database_name",
+				Message: "Could not find database in DB map " + query.DatabaseName})
+		}
+		problems = append(problems, validateQuery(path, &query)...)
+
+		// keep the previous query (and so its cached datablocks) if neither it nor its database changed
+		previousQuery, found := previous.queryMap[query.Name]
+		if found && queryDefinitionEqual(previousQuery, &query) &&
+			previous.dbMap[query.DatabaseName] == cfg.dbMap[query.DatabaseName] {
+			cfg.queryMap[query.Name] = previousQuery
+		} else {
+			cfg.queryMap[query.Name] = &query
+		}
+	}
+
+	// read the cfg/dataselector folder and load all the dataselector json files
+	dataSelectorFiles, dataSelectorPaths, err := readCfgFolder(cfgRoot, cfgFolderDataSelector, false)
+	if err != nil {
+		closeUnusedDatabases(cfg, previous)
+		return nil, nil, err
+	}
+	dataSelectorFilePaths := make(map[string]string)
+	for _, path := range dataSelectorPaths {
+		var dSelector DataSelector
+		err := json.Unmarshal(dataSelectorFiles[path], &dSelector)
+		if err != nil {
+			problems = append(problems, jsonConfigProblem(path, dataSelectorFiles[path], err))
+			continue
+		}
+		if dSelector.Name == "" {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Missing dataselector name"})
+			continue
+		}
+		if _, found := cfg.dataSelectorMap[dSelector.Name]; found {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Duplicate dataselector name " + dSelector.Name})
+			continue
+		}
+		cfg.dataSelectorMap[dSelector.Name] = &dSelector
+		dataSelectorFilePaths[dSelector.Name] = path
+
+		query, found := cfg.queryMap[dSelector.QueryName]
+		if found == false {
+			problems = append(problems, ConfigProblem{File: path, Field: "query_name",
+				Message: "Could not find query in query map " + dSelector.QueryName})
+		} else {
+			cfg.dataSelectorToQueryMap[dSelector.Name] = query
+		}
+		problems = append(problems, validateDataSelectorRules(path, &dSelector, query)...)
+	}
+
+	// read the cfg/variable folder (optional) and load all the variable json files
+	variableFiles, variablePaths, err := readCfgFolder(cfgRoot, cfgFolderVariable, true)
+	if err != nil {
+		closeUnusedDatabases(cfg, previous)
+		return nil, nil, err
+	}
+	variableFilePaths := make(map[string]string)
+	for _, path := range variablePaths {
+		var variable Variable
+		err := json.Unmarshal(variableFiles[path], &variable)
+		if err != nil {
+			problems = append(problems, jsonConfigProblem(path, variableFiles[path], err))
+			continue
+		}
+		if variable.Name == "" {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Missing variable name"})
+			continue
+		}
+		if _, found := cfg.variableMap[variable.Name]; found {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Duplicate variable name " + variable.Name})
+			continue
+		}
+		cfg.variableMap[variable.Name] = &variable
+		variableFilePaths[variable.Name] = path
+
+		query, found := cfg.queryMap[variable.QueryName]
+		if found == false {
+			problems = append(problems, ConfigProblem{File: path, Field: "query_name",
+				Message: "Could not find query in query map " + variable.QueryName})
+		}
+		problems = append(problems, validateVariable(path, &variable, query)...)
+	}
+
+	// read the cfg/annotation folder (optional) and load all the annotation json files
+	annotationFiles, annotationPaths, err := readCfgFolder(cfgRoot, cfgFolderAnnotation, true)
+	if err != nil {
+		closeUnusedDatabases(cfg, previous)
+		return nil, nil, err
+	}
+	annotationFilePaths := make(map[string]string)
+	for _, path := range annotationPaths {
+		var annotation Annotation
+		err := json.Unmarshal(annotationFiles[path], &annotation)
+		if err != nil {
+			problems = append(problems, jsonConfigProblem(path, annotationFiles[path], err))
+			continue
+		}
+		if annotation.Name == "" {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Missing annotation name"})
+			continue
+		}
+		if _, found := cfg.annotationMap[annotation.Name]; found {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Duplicate annotation name " + annotation.Name})
+			continue
+		}
+		cfg.annotationMap[annotation.Name] = &annotation
+		annotationFilePaths[annotation.Name] = path
+
+		query, found := cfg.queryMap[annotation.QueryName]
+		if found == false {
+			problems = append(problems, ConfigProblem{File: path, Field: "query_name",
+				Message: "Could not find query in query map " + annotation.QueryName})
+		}
+		problems = append(problems, validateAnnotation(path, &annotation, query)...)
+	}
+
+	// read the cfg/client folder (optional) and load all the client json files
+	clientFiles, clientPaths, err := readCfgFolder(cfgRoot, cfgFolderClient, true)
+	if err != nil {
+		closeUnusedDatabases(cfg, previous)
+		return nil, nil, err
+	}
+	for _, path := range clientPaths {
+		var client Client
+		err := json.Unmarshal(clientFiles[path], &client)
+		if err != nil {
+			problems = append(problems, jsonConfigProblem(path, clientFiles[path], err))
+			continue
+		}
+		if client.Name == "" {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Missing client name"})
+			continue
+		}
+		if _, found := cfg.clientMap[client.Name]; found {
+			problems = append(problems, ConfigProblem{File: path, Field: "name", Message: "Duplicate client name " + client.Name})
+			continue
+		}
+		if err := client.resolveSecrets(); err != nil {
+			problems = append(problems, ConfigProblem{File: path, Message: err.Error()})
+			continue
+		}
+		if client.APIKey == "" && (client.Username == "" || client.Password == "") {
+			problems = append(problems, ConfigProblem{File: path, Field: "api_key",
+				Message: "Client " + client.Name + " needs an api_key or a username and password"})
+			continue
+		}
+		for _, other := range cfg.clientMap {
+			if client.APIKey != "" && other.APIKey == client.APIKey {
+				problems = append(problems, ConfigProblem{File: path, Field: "api_key",
+					Message: "Client " + client.Name + " has the same api_key as " + other.Name})
+			}
+		}
+		for i, dataSelectorName := range client.DataSelectors {
+			if _, found := cfg.dataSelectorMap[dataSelectorName]; found == false {
+				problems = append(problems, ConfigProblem{File: path, Field: fmt.Sprintf("dataselectors[%d]", i),
+					Message: "Could not find dataselector in dataselector map " + dataSelectorName})
+			}
+		}
+		cfg.clientMap[client.Name] = &client
+	}
+
+	// the dataselector, variable and annotation acls can only be checked once the clients are loaded
+	for _, dSelector := range cfg.dataSelectorMap {
+		problems = append(problems, checkAllowedClients(cfg, dataSelectorFilePaths[dSelector.Name], dSelector.AllowedClients)...)
+	}
+	for _, variable := range cfg.variableMap {
+		problems = append(problems, checkAllowedClients(cfg, variableFilePaths[variable.Name], variable.AllowedClients)...)
+	}
+	for _, annotation := range cfg.annotationMap {
+		problems = append(problems, checkAllowedClients(cfg, annotationFilePaths[annotation.Name], annotation.AllowedClients)...)
+	}
+
+	return cfg, problems, nil
+}
+
+// the problems of an allowed_clients list naming clients that don't exist
+func checkAllowedClients(cfg *Config, path string, allowedClients []string) []ConfigProblem {
+	var problems []ConfigProblem
+	for i, clientName := range allowedClients {
+		if _, found := cfg.clientMap[clientName]; found == false {
+			problems = append(problems, ConfigProblem{File: path,
+				Field: fmt.Sprintf("allowed_clients[%d]", i), Message: "Could not find client in client map " + clientName})
+		}
+	}
+	return problems
+}
+
+// opens the sql.DB for a cfg/db json file
+func openDatabase(genericDB DbConfig, jsonData []byte) (*Database, error) {
+	dbType, found := databaseTypes[genericDB.DBType]
+	if !found {
+		return nil, errors.New("Unknown db type " + genericDB.DBType)
+	}
+
+	dbConfig := dbType.NewConfig()
+	if err := json.Unmarshal(jsonData, dbConfig); err != nil {
+		return nil, err
+	}
+	secrets, err := dbConfig.resolveSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(dbType.DriverName, dbConfig.connectionString())
+	if err != nil {
+		return nil, redactError(err, secrets...)
+	}
+
+	if genericDB.MaxOpenConnections > 0 {
+		db.SetMaxOpenConns(genericDB.MaxOpenConnections)
+	}
+	if genericDB.MaxIdleConnections > 0 {
+		db.SetMaxIdleConns(genericDB.MaxIdleConnections)
+	}
+	if genericDB.ConnectionMaxLifetime > 0 {
+		db.SetConnMaxLifetime(time.Duration(genericDB.ConnectionMaxLifetime) * time.Second)
+	}
+
+	maxConcurrentQueries := genericDB.MaxConcurrentQueries
+	if maxConcurrentQueries <= 0 {
+		maxConcurrentQueries = defaultMaxConcurrentQueries
+	}
+	healthCheckInterval := time.Duration(genericDB.HealthCheckInterval) * time.Second
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = defaultHealthCheckInterval
+	}
+
+	database := &Database{
+		Name:                genericDB.Name,
+		DBType:              genericDB.DBType,
+		DB:                  db,
+		configJSON:          jsonData,
+		refreshSlots:        make(chan struct{}, maxConcurrentQueries),
+		healthCheckInterval: healthCheckInterval,
+		secrets:             secrets,
+	}
+
+	// an unreachable database is kept, it may come up later
+	err = database.checkHealth(context.Background())
+	if err != nil {
+		logger.WithFields(logrus.Fields{"database": database.Name, "error": err}).Warn("Database is down")
+	}
+
+	return database, nil
+}
+
+func queryDefinitionEqual(a *Query, b *Query) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// closes the databases of cfg which are not also used by keep
+func closeUnusedDatabases(cfg *Config, keep *Config) {
+	for name, database := range cfg.dbMap {
+		if keep.dbMap[name] != database {
+			database.DB.Close()
+		}
+	}
+}
+
+// closes the databases of the previous config which a reload removed (or replaced) once the refreshes
+// running on them finish. Requests that got the previous config just before the swap may still be using it
+func closeRemovedDatabases(previous *Config, cfg *Config) {
+	for name, database := range previous.dbMap {
+		if cfg.dbMap[name] != database {
+			database.closeWhenIdle()
+		}
+	}
+}
+
+// counts a refresh starting on the database, false if the database was removed by a reload and is closing
+func (d *Database) startRefresh() bool {
+	d.refreshesLock.Lock()
+	defer d.refreshesLock.Unlock()
+	if d.closing {
+		return false
+	}
+	d.runningRefreshes++
+	return true
+}
+
+// counts a refresh finishing on the database, the last one closes a closing database
+func (d *Database) finishRefresh() {
+	d.refreshesLock.Lock()
+	defer d.refreshesLock.Unlock()
+	d.runningRefreshes--
+	if d.closing && d.runningRefreshes == 0 {
+		d.DB.Close()
+	}
+}
+
+// closes the database now if no refresh is running on it, otherwise once the last one finishes
+func (d *Database) closeWhenIdle() {
+	d.refreshesLock.Lock()
+	defer d.refreshesLock.Unlock()
+	if d.closing {
+		return
+	}
+	d.closing = true
+	if d.runningRefreshes == 0 {
+		d.DB.Close()
+	}
+}
+
+// closes every database of the current config, used on shutdown once the watcher and server are stopped
+func closeAllDatabases() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	closeUnusedDatabases(currentConfig(), newConfig())
+}
+
+// reloads the cfg folders and swaps the new config in. Like at startup the files with a problem are left
+// out and the rest is applied, unless strict is set, then the current config is kept. The problems are
+// returned either way
+func reloadConfig(cfgRoot string, strict bool) ([]ConfigProblem, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	previous := currentConfig()
+	cfg, problems, err := loadConfig(cfgRoot, previous)
+	if err != nil {
+		return nil, err
+	}
+	if strict && len(problems) > 0 {
+		closeUnusedDatabases(cfg, previous)
+		return problems, fmt.Errorf("cfg has %d problems and strict is set, keeping the current config", len(problems))
+	}
+
+	setCurrentConfig(cfg)
+	closeRemovedDatabases(previous, cfg)
+	return problems, nil
+}
+
+func logConfigProblems(problems []ConfigProblem) {
+	for _, problem := range problems {
+		logger.WithFields(logrus.Fields{
+			"file":  problem.File,
+			"field": problem.Field,
+		}).Warn("Config problem: " + problem.Message)
+	}
+}
+
+// a fingerprint of the names, sizes and modification times of the files in the cfg folders
+func cfgFingerprint(cfgRoot string) string {
+	var fingerprint bytes.Buffer
+	for _, folder := range []string{cfgFolderDB, cfgFolderQuery, cfgFolderDataSelector, cfgFolderVariable, cfgFolderAnnotation, cfgFolderClient} {
+		files, _ := ioutil.ReadDir(filepath.Join(cfgRoot, folder))
+		for _, file := range files {
+			fmt.Fprintf(&fingerprint, "%s/%s %d %d\n", folder, file.Name(), file.Size(), file.ModTime().UnixNano())
+		}
+	}
+	return fingerprint.String()
+}
+
+// polls the cfg folders and reloads the config when a file is added, removed or changed, until the context
+// is cancelled
+func watchConfig(ctx context.Context, cfgRoot string, strict bool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastFingerprint := cfgFingerprint(cfgRoot)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fingerprint := cfgFingerprint(cfgRoot)
+		if fingerprint == lastFingerprint {
+			continue
+		}
+		lastFingerprint = fingerprint
+
+		problems, err := reloadConfig(cfgRoot, strict)
+		logConfigProblems(problems)
+		if err != nil {
+			logger.WithError(err).Error("Config reload failed")
+		} else {
+			logger.Info("Config reloaded")
+		}
+	}
+}
+
+type ReloadResponse struct {
+	Reloaded      bool            `json:"reloaded"`
+	Error         string          `json:"error,omitempty"`
+	Problems      []ConfigProblem `json:"problems,omitempty"`
+	Databases     int             `json:"databases"`
+	Queries       int             `json:"queries"`
+	DataSelectors int             `json:"dataselectors"`
+	Variables     int             `json:"variables"`
+	Annotations   int             `json:"annotations"`
+	Clients       int             `json:"clients"`
+}
+
+func postAdminReloadHandler(strict bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		problems, err := reloadConfig(currentConfig().cfgRoot, strict)
+
+		cfg := currentConfig()
+		response := ReloadResponse{
+			Reloaded:      err == nil,
+			Problems:      problems,
+			Databases:     len(cfg.dbMap),
+			Queries:       len(cfg.queryMap),
+			DataSelectors: len(cfg.dataSelectorMap),
+			Variables:     len(cfg.variableMap),
+			Annotations:   len(cfg.annotationMap),
+			Clients:       len(cfg.clientMap),
+		}
+		httpCode := http.StatusOK
+		if err != nil {
+			response.Error = err.Error()
+			httpCode = http.StatusUnprocessableEntity
+		}
+
+		writeJSONResponseWithCode(writer, response, httpCode)
+	}
+}
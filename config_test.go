@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// writes a cfg folder with a sqlite database, the files are name to json
+func writeTestCfg(t *testing.T, cfgRoot string, files map[string]string) {
+	for _, folder := range []string{cfgFolderDB, cfgFolderQuery, cfgFolderDataSelector} {
+		if err := os.MkdirAll(filepath.Join(cfgRoot, folder), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(cfgRoot, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(cfgRoot, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestCfg(t *testing.T) string {
+	cfgRoot, err := ioutil.TempDir("", "dashboard-cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCfg(t, cfgRoot, map[string]string{
+		"db/demo.json":         `{"name": "demo", "db_type": "sqlite", "path": "` + filepath.Join(cfgRoot, "demo.db") + `"}`,
+		"query/q.json":         `{"name": "q", "database_name": "demo", "query_string": "select 1 as v", "refresh_time": 60, "column_list": ["v"]}`,
+		"query/r.json":         `{"name": "r", "database_name": "demo", "query_string": "select 2 as v", "refresh_time": 60, "column_list": ["v"]}`,
+		"dataselector/dq.json": `{"name": "dq", "query_name": "q"}`,
+		"dataselector/dr.json": `{"name": "dr", "query_name": "r"}`,
+	})
+	return cfgRoot
+}
+
+// loads the cfg as the current config, the returned func restores the previous config
+func loadTestCfg(t *testing.T, cfgRoot string) func() {
+	previous := currentConfig()
+	cfg, problems, err := loadConfig(cfgRoot, nil)
+	if err != nil || len(problems) > 0 {
+		t.Fatalf("loading the test cfg: %v %v", err, problems)
+	}
+	setCurrentConfig(cfg)
+	return func() {
+		closeUnusedDatabases(currentConfig(), previous)
+		setCurrentConfig(previous)
+		os.RemoveAll(cfgRoot)
+	}
+}
+
+func TestReloadKeepsUnchangedQueries(t *testing.T) {
+	cfgRoot := newTestCfg(t)
+	defer loadTestCfg(t, cfgRoot)()
+	before := currentConfig()
+
+	writeTestCfg(t, cfgRoot, map[string]string{
+		"query/r.json": `{"name": "r", "database_name": "demo", "query_string": "select 3 as v", "refresh_time": 60, "column_list": ["v"]}`,
+	})
+	if problems, err := reloadConfig(cfgRoot, false); err != nil {
+		t.Fatalf("reload: %v %v", err, problems)
+	}
+	after := currentConfig()
+
+	if after == before {
+		t.Fatal("reload didn't swap in a new config")
+	}
+	if after.queryMap["q"] != before.queryMap["q"] {
+		t.Error("the unchanged query q was replaced, losing its cache")
+	}
+	if after.queryMap["r"] == before.queryMap["r"] || after.queryMap["r"].QueryString != "select 3 as v" {
+		t.Error("the changed query r was not replaced")
+	}
+	if after.dbMap["demo"] != before.dbMap["demo"] {
+		t.Error("the unchanged database was reopened")
+	}
+	if before.queryMap["r"].QueryString != "select 2 as v" {
+		t.Error("the reload modified the previous config")
+	}
+}
+
+func TestReloadWithProblemsAppliesTheValidFiles(t *testing.T) {
+	cfgRoot := newTestCfg(t)
+	defer loadTestCfg(t, cfgRoot)()
+	before := currentConfig()
+
+	writeTestCfg(t, cfgRoot, map[string]string{
+		"dataselector/bad.json": `{"name": "bad", "query_name": "missing"}`,
+		"dataselector/new.json": `{"name": "new", "query_name": "q"}`,
+	})
+	problems, err := reloadConfig(cfgRoot, false)
+	if err != nil || len(problems) != 1 || problems[0].File != filepath.Join(cfgRoot, "dataselector", "bad.json") {
+		t.Fatalf("reload got problems %v, %v, want the bad dataselector's", problems, err)
+	}
+	after := currentConfig()
+	if after == before {
+		t.Fatal("a reload with problems kept the current config, unlike startup")
+	}
+	if _, found := after.dataSelectorMap["new"]; found != true {
+		t.Error("the new dataselector wasn't applied")
+	}
+	if _, found := after.dataSelectorToQueryMap["bad"]; found == true {
+		t.Error("the dataselector with a missing query points at a query")
+	}
+	if after.queryMap["q"] != before.queryMap["q"] {
+		t.Error("the unchanged query q was replaced")
+	}
+}
+
+func TestStrictReloadWithProblemsKeepsCurrentConfig(t *testing.T) {
+	cfgRoot := newTestCfg(t)
+	defer loadTestCfg(t, cfgRoot)()
+	before := currentConfig()
+
+	writeTestCfg(t, cfgRoot, map[string]string{
+		"dataselector/bad.json": `{"name": "bad", "query_name": "missing"}`,
+		"dataselector/new.json": `{"name": "new", "query_name": "q"}`,
+	})
+	problems, err := reloadConfig(cfgRoot, true)
+	if err == nil || len(problems) == 0 {
+		t.Fatal("strict reload of a cfg with problems succeeded")
+	}
+	if currentConfig() != before {
+		t.Fatal("a failed reload replaced the current config")
+	}
+}
+
+func TestConfigSwapIsAtomic(t *testing.T) {
+	cfgRoot := newTestCfg(t)
+	defer loadTestCfg(t, cfgRoot)()
+
+	// readers check every config they get is consistent while reloads swap configs in
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				cfg := currentConfig()
+				for name, dSelector := range cfg.dataSelectorMap {
+					if cfg.dataSelectorToQueryMap[name] != cfg.queryMap[dSelector.QueryName] {
+						t.Errorf("dataselector %s points at a query of another config", name)
+						return
+					}
+				}
+				if len(cfg.queryMap) != 2 || cfg.dbMap["demo"] == nil {
+					t.Errorf("read a partly loaded config: %d queries", len(cfg.queryMap))
+					return
+				}
+			}
+		}()
+	}
+
+	for i, queryString := range []string{"select 3 as v", "select 4 as v", "select 5 as v", "select 6 as v"} {
+		writeTestCfg(t, cfgRoot, map[string]string{
+			"query/r.json": `{"name": "r", "database_name": "demo", "query_string": "` + queryString + `", "refresh_time": 60, "column_list": ["v"]}`,
+		})
+		if problems, err := reloadConfig(cfgRoot, false); err != nil {
+			t.Fatalf("reload %d: %v %v", i, err, problems)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if queryString := currentConfig().queryMap["r"].QueryString; queryString != "select 6 as v" {
+		t.Fatalf("current query r is %q, want the last reload's", queryString)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/go-chi/cors"
+)
+
+// CORSConfig is the cross origin policy of the API, it only matters to browsers calling the API directly
+// (e.g. a grafana datasource in browser access mode), grafana's server access mode doesn't use CORS.
+// Fields that are left empty get the defaults of defaultCORSConfig, an empty allowed_origins is every origin
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"` // e.g. https://grafana.example.com, may contain one * wildcard
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"` // let browsers send cookies and basic auth, needs allowed_origins set
+	MaxAge           int      `json:"max_age"`           // seconds browsers may cache a preflight response
+}
+
+func defaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-API-Key"},
+		ExposedHeaders: []string{"Link"},
+		MaxAge:         300, // Maximum value not ignored by any of major browsers
+	}
+}
+
+// returns the cors config of the server's cors_profile (or its cors if no profile is set) with the
+// defaults filled in
+func (serverCfg ServerConfig) corsConfig() (CORSConfig, error) {
+	corsCfg := serverCfg.CORS
+	if serverCfg.CORSProfile != "" {
+		profile, found := serverCfg.CORSProfiles[serverCfg.CORSProfile]
+		if found != true {
+			return CORSConfig{}, errors.New("Could not find cors profile in cors_profiles " + serverCfg.CORSProfile)
+		}
+		corsCfg = profile
+	}
+
+	defaults := defaultCORSConfig()
+	if len(corsCfg.AllowedOrigins) == 0 {
+		corsCfg.AllowedOrigins = defaults.AllowedOrigins
+	}
+	if len(corsCfg.AllowedMethods) == 0 {
+		corsCfg.AllowedMethods = defaults.AllowedMethods
+	}
+	if len(corsCfg.AllowedHeaders) == 0 {
+		corsCfg.AllowedHeaders = defaults.AllowedHeaders
+	}
+	if len(corsCfg.ExposedHeaders) == 0 {
+		corsCfg.ExposedHeaders = defaults.ExposedHeaders
+	}
+	if corsCfg.MaxAge == 0 {
+		corsCfg.MaxAge = defaults.MaxAge
+	}
+
+	// the cors package answers a credentialed request from any origin with that origin, which would let
+	// every site use the credentials a browser holds for the API
+	if corsCfg.AllowCredentials && containsString(corsCfg.AllowedOrigins, "*") {
+		return CORSConfig{}, errors.New("cors allow_credentials needs allowed_origins to list the origins, not *")
+	}
+	return corsCfg, nil
+}
+
+func (corsCfg CORSConfig) options() cors.Options {
+	return cors.Options{
+		AllowedOrigins:   corsCfg.AllowedOrigins,
+		AllowedMethods:   corsCfg.AllowedMethods,
+		AllowedHeaders:   corsCfg.AllowedHeaders,
+		ExposedHeaders:   corsCfg.ExposedHeaders,
+		AllowCredentials: corsCfg.AllowCredentials,
+		MaxAge:           corsCfg.MaxAge,
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	_ "github.com/denisenkom/go-mssqldb"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/godror/godror"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// DatabaseType is a db_type that can be used in cfg/db. Adding a database type is a config struct
+// implementing DatabaseConfig plus an entry in databaseTypes
+type DatabaseType struct {
+	DriverName      string                // the database/sql driver name
+	NewConfig       func() DatabaseConfig // returns an empty config for the cfg/db json to be unmarshalled into
+	BindPlaceholder func(n int) string    // returns the bind placeholder for the nth (1 based) query parameter
+}
+
+// DatabaseConfig is the db_type specific cfg/db json of a database
+type DatabaseConfig interface {
+	// resolves the secret references in the config and returns the resolved secrets
+	resolveSecrets() ([]Secret, error)
+	connectionString() string
+}
+
+var databaseTypes = map[string]DatabaseType{
+	"oracle": {
+		DriverName:      "godror",
+		NewConfig:       func() DatabaseConfig { return &OracleSIDConfig{} },
+		BindPlaceholder: func(n int) string { return ":" + strconv.Itoa(n) },
+	},
+	"postgres": {
+		DriverName:      "postgres",
+		NewConfig:       func() DatabaseConfig { return &PostgresConfig{} },
+		BindPlaceholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	},
+	"mysql": {
+		DriverName:      "mysql",
+		NewConfig:       func() DatabaseConfig { return &MySQLConfig{} },
+		BindPlaceholder: questionMarkPlaceholder,
+	},
+	"sqlite": {
+		DriverName:      "sqlite3",
+		NewConfig:       func() DatabaseConfig { return &SQLiteConfig{} },
+		BindPlaceholder: questionMarkPlaceholder,
+	},
+	"sqlserver": {
+		DriverName:      "sqlserver",
+		NewConfig:       func() DatabaseConfig { return &SQLServerConfig{} },
+		BindPlaceholder: func(n int) string { return "@p" + strconv.Itoa(n) },
+	},
+}
+
+func questionMarkPlaceholder(n int) string {
+	return "?"
+}
+
+type OracleSIDConfig struct {
+	Name     string `json:"name"`
+	DBType   string `json:"db_type"`
+	Username Secret `json:"username"`
+	Password Secret `json:"password"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	SIDName  string `json:"sid_name"`
+}
+
+func (cfg *OracleSIDConfig) resolveSecrets() ([]Secret, error) {
+	err := resolveCredentials(&cfg.Username, &cfg.Password)
+	return []Secret{cfg.Password}, err
+}
+
+func (cfg OracleSIDConfig) connectionString() string {
+	return fmt.Sprintf("%s/%s@(DESCRIPTION=(ADDRESS_LIST=(ADDRESS="+
+		"(PROTOCOL=tcp)(HOST=%s)(PORT=%d)))(CONNECT_DATA=(SID=%s)))",
+		string(cfg.Username), string(cfg.Password), cfg.Host, cfg.Port, cfg.SIDName)
+}
+
+type PostgresConfig struct {
+	Name     string `json:"name"`
+	DBType   string `json:"db_type"`
+	DBName   string `json:"db_name"`
+	Username Secret `json:"username"`
+	Password Secret `json:"password"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+}
+
+func (cfg *PostgresConfig) resolveSecrets() ([]Secret, error) {
+	err := resolveCredentials(&cfg.Username, &cfg.Password)
+	return []Secret{cfg.Password}, err
+}
+
+func (cfg PostgresConfig) connectionString() string {
+	return fmt.Sprintf("host=%s port=%d user=%s "+
+		"password=%s dbname=%s sslmode=disable",
+		cfg.Host, cfg.Port, string(cfg.Username), string(cfg.Password), cfg.DBName)
+}
+
+type MySQLConfig struct {
+	Name     string `json:"name"`
+	DBType   string `json:"db_type"`
+	DBName   string `json:"db_name"`
+	Username Secret `json:"username"`
+	Password Secret `json:"password"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+}
+
+func (cfg *MySQLConfig) resolveSecrets() ([]Secret, error) {
+	err := resolveCredentials(&cfg.Username, &cfg.Password)
+	return []Secret{cfg.Password}, err
+}
+
+func (cfg MySQLConfig) connectionString() string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
+		string(cfg.Username), string(cfg.Password), cfg.Host, cfg.Port, cfg.DBName)
+}
+
+// SQLiteConfig is a sqlite database file, useful for demos and trying out cfg without a database server
+type SQLiteConfig struct {
+	Name     string `json:"name"`
+	DBType   string `json:"db_type"`
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+func (cfg *SQLiteConfig) resolveSecrets() ([]Secret, error) {
+	return nil, nil
+}
+
+func (cfg SQLiteConfig) connectionString() string {
+	connectionString := "file:" + cfg.Path + "?_busy_timeout=5000"
+	if cfg.ReadOnly {
+		connectionString += "&mode=ro"
+	}
+	return connectionString
+}
+
+type SQLServerConfig struct {
+	Name     string `json:"name"`
+	DBType   string `json:"db_type"`
+	DBName   string `json:"db_name"`
+	Username Secret `json:"username"`
+	Password Secret `json:"password"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Instance string `json:"instance"` // named instance, leave empty for the default instance
+}
+
+func (cfg *SQLServerConfig) resolveSecrets() ([]Secret, error) {
+	err := resolveCredentials(&cfg.Username, &cfg.Password)
+	return []Secret{cfg.Password}, err
+}
+
+func (cfg SQLServerConfig) connectionString() string {
+	query := url.Values{}
+	query.Set("database", cfg.DBName)
+
+	// without a port the driver looks the named instance's port up with the SQL Browser service
+	host := cfg.Host
+	if cfg.Port != 0 {
+		host = fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	}
+
+	connectionURL := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(string(cfg.Username), string(cfg.Password)),
+		Host:     host,
+		Path:     cfg.Instance,
+		RawQuery: query.Encode(),
+	}
+	return connectionURL.String()
+}
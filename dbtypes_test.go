@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestSQLServerConnectionString(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  SQLServerConfig
+		want string
+	}{
+		{"default instance", SQLServerConfig{DBName: "db", Username: "u", Password: "p", Host: "sql1", Port: 1433},
+			"sqlserver://u:p@sql1:1433?database=db"},
+		{"named instance", SQLServerConfig{DBName: "db", Username: "u", Password: "p", Host: "sql1", Instance: "REPORTS"},
+			"sqlserver://u:p@sql1/REPORTS?database=db"},
+		{"named instance with a port", SQLServerConfig{DBName: "db", Username: "u", Password: "p", Host: "sql1", Port: 1500, Instance: "REPORTS"},
+			"sqlserver://u:p@sql1:1500/REPORTS?database=db"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.cfg.connectionString(); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -3,11 +3,15 @@ module dashboard
 go 1.13
 
 require (
+	github.com/denisenkom/go-mssqldb v0.9.0
 	github.com/go-chi/chi v4.0.2+incompatible
 	github.com/go-chi/cors v1.0.0
 	github.com/go-sql-driver/mysql v1.4.1
 	github.com/godror/godror v0.14.0
 	github.com/lib/pq v1.2.0
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/prometheus/client_golang v1.11.1
+	github.com/sirupsen/logrus v1.8.1
 	google.golang.org/appengine v1.6.5 // indirect
 	gopkg.in/goracle.v2 v2.21.4 // indirect
 )
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// used for a database whose cfg doesn't set health_check_interval
+const defaultHealthCheckInterval = 30 * time.Second
+
+// how long a health check ping may take before the database is reported down
+const healthCheckTimeout = 5 * time.Second
+
+// how often the health checker looks for databases that are due a ping
+const healthCheckTickInterval = time.Second
+
+// DatabaseHealth is the result of the latest ping of a database
+type DatabaseHealth struct {
+	lock          sync.Mutex // guards everything below
+	checking      bool
+	lastCheckTime time.Time
+	pingLatency   time.Duration
+	lastError     error
+}
+
+// pings the database and records the result
+func (d *Database) checkHealth(ctx context.Context) error {
+	pingCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	startTime := time.Now()
+	err := redactError(d.DB.PingContext(pingCtx), d.secrets...)
+	latency := time.Since(startTime)
+
+	d.health.lock.Lock()
+	d.health.lastCheckTime = startTime
+	d.health.pingLatency = latency
+	d.health.lastError = err
+	d.health.lock.Unlock()
+	return err
+}
+
+// marks the database as being checked if its health check interval has passed and no check is running
+func (d *Database) startHealthCheckIfDue(now time.Time) bool {
+	d.health.lock.Lock()
+	defer d.health.lock.Unlock()
+
+	if d.health.checking || now.Sub(d.health.lastCheckTime) < d.healthCheckInterval {
+		return false
+	}
+	d.health.checking = true
+	return true
+}
+
+func (d *Database) finishHealthCheck() {
+	d.health.lock.Lock()
+	d.health.checking = false
+	d.health.lock.Unlock()
+}
+
+// pings every database of the current config on its health check interval until the context is cancelled
+func runHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(healthCheckTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, database := range currentConfig().dbMap {
+				if database.startHealthCheckIfDue(now) {
+					go func(database *Database) {
+						defer database.finishHealthCheck()
+						database.checkHealth(ctx)
+					}(database)
+				}
+			}
+		}
+	}
+}
+
+type DatabaseHealthStatus struct {
+	Name          string             `json:"name"`
+	DBType        string             `json:"db_type"`
+	Status        string             `json:"status"` // up, down or unknown (not checked yet)
+	LastCheckTime time.Time          `json:"last_check_time"`
+	PingLatencyMS float64            `json:"ping_latency_ms"`
+	Error         string             `json:"error,omitempty"`
+	Pool          DatabasePoolStatus `json:"pool"`
+}
+
+// DatabasePoolStatus is the connection pool part of sql.DBStats
+type DatabasePoolStatus struct {
+	MaxOpenConnections int   `json:"max_open_connections"`
+	OpenConnections    int   `json:"open_connections"`
+	InUse              int   `json:"in_use"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMS     int64 `json:"wait_duration_ms"`
+	MaxIdleClosed      int64 `json:"max_idle_closed"`
+	MaxLifetimeClosed  int64 `json:"max_lifetime_closed"`
+}
+
+func (d *Database) healthStatus() DatabaseHealthStatus {
+	d.health.lock.Lock()
+	status := DatabaseHealthStatus{
+		Name:          d.Name,
+		DBType:        d.DBType,
+		Status:        "up",
+		LastCheckTime: d.health.lastCheckTime,
+		PingLatencyMS: float64(d.health.pingLatency) / float64(time.Millisecond),
+	}
+	if d.health.lastCheckTime.IsZero() {
+		status.Status = "unknown"
+	} else if d.health.lastError != nil {
+		status.Status = "down"
+		status.Error = d.health.lastError.Error()
+	}
+	d.health.lock.Unlock()
+
+	stats := d.DB.Stats()
+	status.Pool = DatabasePoolStatus{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMS:     int64(stats.WaitDuration / time.Millisecond),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+	return status
+}
+
+// lists the health of every database, the response is 503 if any of them is down so it can be used as a probe
+func getDatabaseHealthHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := []DatabaseHealthStatus{}
+	httpCode := http.StatusOK
+	for _, database := range currentConfig().dbMap {
+		status := database.healthStatus()
+		if status.Status == "down" {
+			httpCode = http.StatusServiceUnavailable
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	writeJSONResponseWithCode(w, statuses, httpCode)
+}
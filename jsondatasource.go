@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+)
+
+// the formats a target can be rendered as, timeserie and table for the simple json datasource and frame
+// (a data frame) for the json datasource
+var targetFormats = []string{"timeserie", "table", "frame"}
+
+// the payload of a json datasource target, an object of payload name to value (a string or a list for a
+// multi-select). Older versions of the datasource send the payload as a string holding the json object.
+// The format payload picks the target's format, every other payload is a variable of the target's query
+func (target Target) payload() (map[string]interface{}, error) {
+	if len(target.Payload) == 0 || string(target.Payload) == "null" {
+		return nil, nil
+	}
+	payloadJSON := []byte(target.Payload)
+	var payloadString string
+	if err := json.Unmarshal(target.Payload, &payloadString); err == nil {
+		if payloadString == "" {
+			return nil, nil
+		}
+		payloadJSON = []byte(payloadString)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return nil, errors.New("the payload must be a json object")
+	}
+	return payload, nil
+}
+
+// the format the target is rendered as, the format payload or else the target's type
+func (target Target) format(payload map[string]interface{}) string {
+	if format, ok := payload["format"].(string); ok && format != "" {
+		return format
+	}
+	if target.Type == "" {
+		return "timeserie"
+	}
+	return target.Type
+}
+
+// the payload values that are variables, everything but the format
+func payloadVariables(payload map[string]interface{}) map[string]interface{} {
+	variables := make(map[string]interface{})
+	for name, value := range payload {
+		if name != "format" {
+			variables[name] = value
+		}
+	}
+	return variables
+}
+
+// the options of the format payload
+func formatPayloadOptions() []GrafanaMetricPayloadOption {
+	var options []GrafanaMetricPayloadOption
+	for _, format := range targetFormats {
+		options = append(options, GrafanaMetricPayloadOption{Label: format, Value: format})
+	}
+	return options
+}
+
+// the payloads of a dataselector, the format and a payload per variable its query references. Variables
+// with a cfg/variable definition are selects whose options are fetched from /metric-payload-options
+func dataSelectorPayloads(cfg *Config, dSelector *DataSelector) []GrafanaMetricPayload {
+	payloads := []GrafanaMetricPayload{{
+		Label:   "Format",
+		Name:    "format",
+		Type:    "select",
+		Options: formatPayloadOptions(),
+	}}
+
+	query, found := cfg.dataSelectorToQueryMap[dSelector.Name]
+	if found != true {
+		return payloads
+	}
+	for _, name := range queryStringVariableNames(query.QueryString) {
+		payload := GrafanaMetricPayload{Label: name, Name: name, Type: "input"}
+		if _, found := cfg.variableMap[name]; found {
+			payload.Type = "select"
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+// the json datasource's list of metrics, the dataselectors the client may use with their payloads
+func postMetricsHandler(writer http.ResponseWriter, request *http.Request) {
+	// the request only carries the metric and payload being edited, the full list is returned either way
+	cfg := currentConfig()
+	client := clientFromContext(request.Context())
+	var dataSelectorNames []string
+	for name, dSelector := range cfg.dataSelectorMap {
+		if client.canAccessDataSelector(dSelector) {
+			dataSelectorNames = append(dataSelectorNames, name)
+		}
+	}
+	sort.Strings(dataSelectorNames)
+
+	metrics := []GrafanaMetric{}
+	for _, name := range dataSelectorNames {
+		metrics = append(metrics, GrafanaMetric{
+			Label:    name,
+			Value:    name,
+			Payloads: dataSelectorPayloads(cfg, cfg.dataSelectorMap[name]),
+		})
+	}
+	writeJSONResponse(writer, metrics)
+}
+
+// the options of a select payload of a metric, the formats or the values of the payload's variable. The
+// other payload values of the request are variables of the variable's query
+func postMetricPayloadOptionsHandler(writer http.ResponseWriter, request *http.Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var optionsRequest GrafanaMetricPayloadOptionsRequest
+	err = json.Unmarshal(body, &optionsRequest)
+	if err != nil {
+		http.Error(writer, "Invalid metric payload options request json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg := currentConfig()
+	dSelector, found := cfg.dataSelectorMap[optionsRequest.Metric]
+	if found != true {
+		http.Error(writer, "Could not find dataselector in dataselector map "+optionsRequest.Metric, http.StatusNotFound)
+		return
+	}
+	if httpCode, errorString := checkDataSelectorAccess(request.Context(), dSelector); errorString != "" {
+		http.Error(writer, errorString, httpCode)
+		return
+	}
+
+	if optionsRequest.Name == "format" {
+		writeJSONResponse(writer, formatPayloadOptions())
+		return
+	}
+	// only the variables of the dataselector's own query, the dataselector's acl doesn't cover other variables
+	query, found := cfg.dataSelectorToQueryMap[dSelector.Name]
+	if found != true || !containsString(queryStringVariableNames(query.QueryString), optionsRequest.Name) {
+		http.Error(writer, "Dataselector "+dSelector.Name+" has no payload "+optionsRequest.Name, http.StatusNotFound)
+		return
+	}
+
+	params := defaultQueryParameters().withVariables(payloadVariables(optionsRequest.Payload))
+	values, httpCode, errorString := getVariableValues(request.Context(), optionsRequest.Name, params)
+	if errorString != "" {
+		http.Error(writer, errorString, httpCode)
+		return
+	}
+
+	options := []GrafanaMetricPayloadOption{}
+	for _, value := range values {
+		options = append(options, GrafanaMetricPayloadOption{Label: value.Text, Value: value.Value})
+	}
+	writeJSONResponse(writer, options)
+}
+
+// *************Grafana json datasource json stuff
+type GrafanaMetric struct {
+	Label    string                 `json:"label"`
+	Value    string                 `json:"value"`
+	Payloads []GrafanaMetricPayload `json:"payloads"`
+}
+
+type GrafanaMetricPayload struct {
+	Label        string                       `json:"label"`
+	Name         string                       `json:"name"`
+	Type         string                       `json:"type"` // select, multi-select, input or textarea
+	Placeholder  string                       `json:"placeholder,omitempty"`
+	ReloadMetric bool                         `json:"reloadMetric,omitempty"`
+	Options      []GrafanaMetricPayloadOption `json:"options,omitempty"` // fetched from /metric-payload-options if not set
+}
+
+type GrafanaMetricPayloadOption struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+type GrafanaMetricPayloadOptionsRequest struct {
+	Metric  string                 `json:"metric"`
+	Payload map[string]interface{} `json:"payload"`
+	Name    string                 `json:"name"`
+}
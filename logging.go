@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+// the logger everything logs through, configured from the server config by configureLogging
+var logger = logrus.New()
+
+// sets the logger's level (debug, info, warn or error) and format (text or json)
+func configureLogging(level string, format string) error {
+	logLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(logLevel)
+	logger.SetOutput(os.Stdout)
+
+	switch format {
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.New("Unknown log format " + format + ", use text or json")
+	}
+	return nil
+}
+
+// returns the logger for a request, with the request's id (and client if authenticated) as fields
+func requestLogger(ctx context.Context) *logrus.Entry {
+	entry := logger.WithField("request_id", middleware.GetReqID(ctx))
+	if client := clientFromContext(ctx); client != nil {
+		entry = entry.WithField("client", client.Name)
+	}
+	return entry
+}
+
+// logs every request once it is served, after the request id middleware. Server errors are logged at
+// warn level, everything else at debug
+func requestLoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		// lets a caller match a response (or error) to the log lines of its request
+		w.Header().Set("X-Request-Id", middleware.GetReqID(r.Context()))
+		next.ServeHTTP(ww, r)
+
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		route := ""
+		if routeContext := chi.RouteContext(r.Context()); routeContext != nil {
+			route = routeContext.RoutePattern()
+		}
+		entry := requestLogger(r.Context()).WithFields(logrus.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"route":       route,
+			"status":      code,
+			"bytes":       ww.BytesWritten(),
+			"duration_ms": time.Since(startTime).Milliseconds(),
+			"remote_addr": r.RemoteAddr,
+		})
+		if code >= http.StatusInternalServerError {
+			entry.Warn("Request failed")
+		} else {
+			entry.Debug("Request served")
+		}
+	})
+}
+
+// turns a panic in a handler into a logged error and a 500 rather than a dropped connection
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				requestLogger(r.Context()).WithFields(logrus.Fields{
+					"panic": recovered,
+					"stack": string(debug.Stack()),
+				}).Error("Handler panicked")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the range used when a request does not carry one, matches grafana's default dashboard range
+const defaultTimeRangeDuration = 6 * time.Hour
+
+// TimeRange is the resolved time range (and interval) a query is bound against
+type TimeRange struct {
+	From       time.Time
+	To         time.Time
+	RawFrom    string
+	RawTo      string
+	Interval   string
+	IntervalMS int64
+}
+
+func defaultTimeRange() TimeRange {
+	now := time.Now()
+	return TimeRange{
+		From:    now.Add(-defaultTimeRangeDuration),
+		To:      now,
+		RawFrom: "now-6h",
+		RawTo:   "now",
+	}
+}
+
+// builds the time range from the range/interval fields of a grafana query request
+// if the request has no range then the default range is used
+func timeRangeFromGrafanaRequest(r GrafanaQueryRequest) (TimeRange, error) {
+	if r.Range.From == "" && r.Range.To == "" {
+		tr := defaultTimeRange()
+		tr.Interval = r.Interval
+		tr.IntervalMS = r.IntervalMS
+		return tr, nil
+	}
+
+	from, err := parseTimeValue(r.Range.From)
+	if err != nil {
+		return TimeRange{}, fmt.Errorf("invalid range.from %q: %v", r.Range.From, err)
+	}
+	to, err := parseTimeValue(r.Range.To)
+	if err != nil {
+		return TimeRange{}, fmt.Errorf("invalid range.to %q: %v", r.Range.To, err)
+	}
+	if to.Before(from) {
+		return TimeRange{}, errors.New("range.to is before range.from")
+	}
+
+	return TimeRange{
+		From:       from,
+		To:         to,
+		RawFrom:    r.Range.Raw.From,
+		RawTo:      r.Range.Raw.To,
+		Interval:   r.Interval,
+		IntervalMS: r.IntervalMS,
+	}, nil
+}
+
+// builds the time range from the from/to url parameters (RFC3339 or epoch ms)
+// if they are not set then the default range is used, a to without a from is the default length up to it
+func timeRangeFromURL(r *http.Request) (TimeRange, error) {
+	fromParam := r.URL.Query().Get("from")
+	toParam := r.URL.Query().Get("to")
+
+	tr := defaultTimeRange()
+	if fromParam != "" {
+		from, err := parseTimeValue(fromParam)
+		if err != nil {
+			return TimeRange{}, fmt.Errorf("invalid from %q: %v", fromParam, err)
+		}
+		tr.From = from
+		tr.RawFrom = fromParam
+	}
+	if toParam != "" {
+		to, err := parseTimeValue(toParam)
+		if err != nil {
+			return TimeRange{}, fmt.Errorf("invalid to %q: %v", toParam, err)
+		}
+		tr.To = to
+		tr.RawTo = toParam
+		// the default length back from to, so the range (and its cache key) is the same on every request
+		if fromParam == "" {
+			tr.From = to.Add(-defaultTimeRangeDuration)
+			tr.RawFrom = ""
+		}
+	}
+	if tr.To.Before(tr.From) {
+		return TimeRange{}, errors.New("to is before from")
+	}
+	return tr, nil
+}
+
+// accepts RFC3339 timestamps (what grafana sends) or epoch milliseconds
+func parseTimeValue(value string) (time.Time, error) {
+	if epochMS, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, epochMS*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// a relative range (e.g. now-6h to now) moves with the clock, so it is keyed by its raw
+// definition rather than by the resolved times which are different on every request
+func (tr TimeRange) isRelative() bool {
+	return strings.HasPrefix(tr.RawTo, "now")
+}
+
+// key used to separate the cached results of a query for different time ranges, json encoded so the raw
+// values sent by the caller can't run into each other
+func (tr TimeRange) cacheKey() string {
+	keyParts := []string{tr.From.UTC().Format(time.RFC3339Nano), tr.To.UTC().Format(time.RFC3339Nano), tr.Interval}
+	if tr.isRelative() {
+		keyParts = []string{tr.RawFrom, tr.RawTo, tr.Interval}
+	}
+	return encodeCacheKey(keyParts)
+}
+
+// a relative range moved along so it ends now (keeping its length), other ranges are returned as they are
+func (tr TimeRange) movedToNow() TimeRange {
+	if !tr.isRelative() {
+		return tr
+	}
+	length := tr.To.Sub(tr.From)
+	tr.To = time.Now()
+	tr.From = tr.To.Add(-length)
+	return tr
+}
+
+// QueryParameters are the values a query string is bound against for one request
+type QueryParameters struct {
+	TimeRange     TimeRange
+	Variables     map[string]interface{} // template variable name to its value (a string or a list of values)
+	AdhocFilters  []AdhocCondition
+	MaxDataPoints int64 // the most points grafana can show for a target, 0 is no limit
+}
+
+// AdhocCondition is an adhoc filter resolved to the column and sql operator it applies to
+type AdhocCondition struct {
+	Column   string
+	Operator string
+	Value    interface{}
+}
+
+func defaultQueryParameters() QueryParameters {
+	return QueryParameters{TimeRange: defaultTimeRange()}
+}
+
+// matches (in this order) $__timeFilter(column), the other macros, and variable references in the
+// $name, ${name} and [[name]] forms. Use queryStringReferences rather than matching with it directly
+var queryStringRegex = regexp.MustCompile(`\$__timeFilter\(\s*([^)]*?)\s*\)|\$__(timeFrom|timeTo|interval_ms|interval|adhocFilters)\b|\$\{([A-Za-z_]\w*)\}|\[\[([A-Za-z_]\w*)\]\]|\$([A-Za-z_]\w*)`)
+
+const (
+	matchTimeFilterColumn = 1
+	matchMacroName        = 2
+	matchVariableName     = 3 // the ${name}, [[name]] and $name groups are 3, 4 and 5
+	matchBareVariableName = 5
+)
+
+// returns the submatches of the macro and variable references in the query string with their start and
+// end offsets. A $name right after a word character is part of an identifier (e.g. oracle's v$session)
+// and not a reference
+func queryStringReferences(queryString string) (matches [][]string, offsets [][2]int) {
+	for _, index := range queryStringRegex.FindAllStringSubmatchIndex(queryString, -1) {
+		start, end := index[0], index[1]
+		if index[2*matchBareVariableName] != -1 && start > 0 && isWordByte(queryString[start-1]) {
+			continue
+		}
+		match := make([]string, len(index)/2)
+		for i := range match {
+			if index[2*i] != -1 {
+				match[i] = queryString[index[2*i]:index[2*i+1]]
+			}
+		}
+		matches = append(matches, match)
+		offsets = append(offsets, [2]int{start, end})
+	}
+	return matches, offsets
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || ('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+func variableNameFromMatch(match []string) string {
+	for i := matchVariableName; i < len(match); i++ {
+		if match[i] != "" {
+			return match[i]
+		}
+	}
+	return ""
+}
+
+// returns a copy of the parameters with the variables added, replacing variables of the same name
+func (p QueryParameters) withVariables(variables map[string]interface{}) QueryParameters {
+	if len(variables) == 0 {
+		return p
+	}
+	merged := make(map[string]interface{}, len(p.Variables)+len(variables))
+	for name, value := range p.Variables {
+		merged[name] = value
+	}
+	for name, value := range variables {
+		merged[name] = value
+	}
+	p.Variables = merged
+	return p
+}
+
+// returns the names of the variables the query string references, in the order they are first referenced
+// grafana's own __ variables are left out
+func queryStringVariableNames(queryString string) []string {
+	var names []string
+	matches, _ := queryStringReferences(queryString)
+	for _, match := range matches {
+		name := variableNameFromMatch(match)
+		if name != "" && !strings.HasPrefix(name, "__") && !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// key used to separate the cached results of a query for different parameters, only the parameters the
+// query string actually references are part of the key so queries without any share a single entry
+func (p QueryParameters) cacheKey(queryString string) string {
+	usesTimeRange := false
+	usesAdhocFilters := false
+	usedVariables := make(map[string]bool)
+
+	matches, _ := queryStringReferences(queryString)
+	for _, match := range matches {
+		switch {
+		case strings.HasPrefix(match[0], "$__timeFilter"):
+			usesTimeRange = true
+		case match[matchMacroName] == "adhocFilters":
+			usesAdhocFilters = true
+		case match[matchMacroName] != "":
+			usesTimeRange = true
+		default:
+			name := variableNameFromMatch(match)
+			if _, found := p.Variables[name]; found {
+				usedVariables[name] = true
+			}
+		}
+	}
+
+	// the scheduler keeps the entry of a query without parameters, whose key is empty, loaded
+	if !usesTimeRange && !usesAdhocFilters && len(usedVariables) == 0 {
+		return ""
+	}
+
+	// json encoded so values can't run into each other, e.g. "1|b=2" and "3" must not key like "1" and "2|b=3"
+	var key struct {
+		TimeRange    string           `json:"time_range,omitempty"`
+		AdhocFilters []AdhocCondition `json:"adhoc_filters,omitempty"`
+		Variables    [][2]interface{} `json:"variables,omitempty"` // name and value, sorted by name
+	}
+	if usesTimeRange {
+		key.TimeRange = p.TimeRange.cacheKey()
+	}
+	if usesAdhocFilters {
+		key.AdhocFilters = p.AdhocFilters
+	}
+	var variableNames []string
+	for name := range usedVariables {
+		variableNames = append(variableNames, name)
+	}
+	sort.Strings(variableNames)
+	for _, name := range variableNames {
+		key.Variables = append(key.Variables, [2]interface{}{name, p.Variables[name]})
+	}
+	return encodeCacheKey(key)
+}
+
+// the json encoding of a cache key, values that can't be encoded (which the request json can't hold) fall
+// back to their go syntax representation
+func encodeCacheKey(key interface{}) string {
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Sprintf("%#v", key)
+	}
+	return string(keyJSON)
+}
+
+// returns the bind placeholder for the nth (1 based) parameter of the db type's driver
+func bindPlaceholder(dbType string, n int) string {
+	if databaseType, found := databaseTypes[dbType]; found {
+		return databaseType.BindPlaceholder(n)
+	}
+	return "?"
+}
+
+// replaces the macros and variable references in the query string with bind placeholders for the db type
+// and returns the rewritten query string with the values to bind, in placeholder order. Values are never
+// written into the sql text, references to variables that are not in the parameters are left as they are
+func expandQueryString(queryString string, dbType string, params QueryParameters) (string, []interface{}) {
+	var args []interface{}
+
+	bind := func(value interface{}) string {
+		args = append(args, value)
+		return bindPlaceholder(dbType, len(args))
+	}
+
+	// multi value variables are bound as a comma separated list of placeholders for use in IN (...)
+	bindVariable := func(value interface{}) string {
+		values, isList := value.([]interface{})
+		if !isList {
+			return bind(value)
+		}
+		if len(values) == 0 {
+			return bind(nil)
+		}
+		placeholders := make([]string, len(values))
+		for i := range values {
+			placeholders[i] = bind(values[i])
+		}
+		return strings.Join(placeholders, ", ")
+	}
+
+	expand := func(match []string) string {
+		reference := match[0]
+		if strings.HasPrefix(reference, "$__timeFilter") {
+			return match[matchTimeFilterColumn] + " BETWEEN " + bind(params.TimeRange.From) + " AND " + bind(params.TimeRange.To)
+		}
+
+		switch match[matchMacroName] {
+		case "timeFrom":
+			return bind(params.TimeRange.From)
+		case "timeTo":
+			return bind(params.TimeRange.To)
+		case "interval_ms":
+			return bind(params.TimeRange.IntervalMS)
+		case "interval":
+			return bind(params.TimeRange.Interval)
+		case "adhocFilters":
+			if len(params.AdhocFilters) == 0 {
+				return "1=1"
+			}
+			conditions := make([]string, len(params.AdhocFilters))
+			for i, filter := range params.AdhocFilters {
+				conditions[i] = filter.Column + " " + filter.Operator + " " + bind(filter.Value)
+			}
+			return "(" + strings.Join(conditions, " AND ") + ")"
+		}
+
+		value, found := params.Variables[variableNameFromMatch(match)]
+		if !found {
+			return reference
+		}
+		return bindVariable(value)
+	}
+
+	var expanded strings.Builder
+	matches, offsets := queryStringReferences(queryString)
+	previousEnd := 0
+	for i, match := range matches {
+		expanded.WriteString(queryString[previousEnd:offsets[i][0]])
+		expanded.WriteString(expand(match))
+		previousEnd = offsets[i][1]
+	}
+	expanded.WriteString(queryString[previousEnd:])
+	return expanded.String(), args
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimeRangeFromURL(t *testing.T) {
+	from := time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		query    string
+		wantFrom time.Time // zero if the range is relative to now
+		wantTo   time.Time
+		wantErr  bool
+	}{
+		{"default", "", time.Time{}, time.Time{}, false},
+		{"from and to", "?from=2026-10-17T01:00:00Z&to=2026-10-17T03:00:00Z", from, to, false},
+		{"epoch ms", "?from=1792198800000&to=1792206000000", time.Unix(1792198800, 0), time.Unix(1792206000, 0), false},
+		{"only to", "?to=2026-10-17T03:00:00Z", to.Add(-defaultTimeRangeDuration), to, false},
+		{"to before from", "?from=2026-10-17T03:00:00Z&to=2026-10-17T01:00:00Z", time.Time{}, time.Time{}, true},
+		{"only to with an empty from", "?to=2026-10-17T03:00:00Z&from=", to.Add(-defaultTimeRangeDuration), to, false},
+		{"invalid to", "?to=yesterday", time.Time{}, time.Time{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, err := timeRangeFromURL(httptest.NewRequest("GET", "/query"+test.query, nil))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", tr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.wantFrom.IsZero() {
+				if !tr.isRelative() {
+					t.Fatalf("got %v, want a range relative to now", tr)
+				}
+				return
+			}
+			if !tr.From.Equal(test.wantFrom) || !tr.To.Equal(test.wantTo) || tr.isRelative() {
+				t.Fatalf("got %v to %v (relative %v), want %v to %v", tr.From, tr.To, tr.isRelative(), test.wantFrom, test.wantTo)
+			}
+		})
+	}
+}
+
+func TestTimeRangeFromURLWithOnlyToHasAStableCacheKey(t *testing.T) {
+	request := httptest.NewRequest("GET", "/query?to=2026-10-17T03:00:00Z", nil)
+	first, err := timeRangeFromURL(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	second, _ := timeRangeFromURL(request)
+	if first.cacheKey() != second.cacheKey() {
+		t.Fatalf("cache keys %q and %q differ", first.cacheKey(), second.cacheKey())
+	}
+	if moved := first.movedToNow(); !moved.From.Equal(first.From) {
+		t.Fatal("a range with an absolute to was moved to now")
+	}
+}
+
+func TestExpandQueryString(t *testing.T) {
+	from := time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	params := QueryParameters{
+		TimeRange: TimeRange{From: from, To: to, Interval: "1m", IntervalMS: 60000},
+		Variables: map[string]interface{}{
+			"host":    "web1",
+			"hosts":   []interface{}{"web1", "web2"},
+			"none":    []interface{}{},
+			"session": "1",
+		},
+		AdhocFilters: []AdhocCondition{{Column: "region", Operator: "=", Value: "eu"}},
+	}
+
+	tests := []struct {
+		name        string
+		queryString string
+		dbType      string
+		want        string
+		wantArgs    []interface{}
+	}{
+		{"time filter", "select * from t where $__timeFilter(ts)", "postgres",
+			"select * from t where ts BETWEEN $1 AND $2", []interface{}{from, to}},
+		{"macros", "select $__timeFrom, $__timeTo, $__interval_ms, $__interval", "mysql",
+			"select ?, ?, ?, ?", []interface{}{from, to, int64(60000), "1m"}},
+		{"oracle placeholders", "select * from t where host = $host and $__timeFilter(ts)", "oracle",
+			"select * from t where host = :1 and ts BETWEEN :2 AND :3", []interface{}{"web1", from, to}},
+		{"sqlserver placeholders", "select * from t where host = ${host} and ts > $__timeFrom", "sqlserver",
+			"select * from t where host = @p1 and ts > @p2", []interface{}{"web1", from}},
+		{"sqlite placeholders", "select * from t where host = [[host]]", "sqlite",
+			"select * from t where host = ?", []interface{}{"web1"}},
+		{"multi value list", "select * from t where host in ($hosts) and h = $host", "postgres",
+			"select * from t where host in ($1, $2) and h = $3", []interface{}{"web1", "web2", "web1"}},
+		{"empty multi value list", "select * from t where host in ($none)", "mysql",
+			"select * from t where host in (?)", []interface{}{nil}},
+		{"missing variable is left as it is", "select * from t where host = $missing and h = ${other}", "mysql",
+			"select * from t where host = $missing and h = ${other}", nil},
+		{"adhoc filters", "select * from t where $__adhocFilters", "postgres",
+			"select * from t where (region = $1)", []interface{}{"eu"}},
+		{"oracle v$ views aren't variables", "select name from v$session, gv$session where s = $session", "oracle",
+			"select name from v$session, gv$session where s = :1", []interface{}{"1"}},
+		{"variable at the start and after punctuation", "$host,($host)", "mysql",
+			"?,(?)", []interface{}{"web1", "web1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, args := expandQueryString(test.queryString, test.dbType, params)
+			if got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+			if !reflect.DeepEqual(args, test.wantArgs) {
+				t.Fatalf("got args %#v, want %#v", args, test.wantArgs)
+			}
+		})
+	}
+
+	if _, args := expandQueryString("select $__adhocFilters", "mysql", defaultQueryParameters()); args != nil {
+		t.Fatalf("no adhoc filters bound %v", args)
+	}
+	if names := queryStringVariableNames("select $a, v$session, ${b}, [[a]], $__timeFrom, $__x"); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Fatalf("got variable names %v", names)
+	}
+}
+
+func TestCacheKeyIsUniquePerBoundValues(t *testing.T) {
+	queryString := "select * from t where a = $a and b = $b and c in ($c) and $__adhocFilters"
+	params := func(a, b, c interface{}, filters ...AdhocCondition) QueryParameters {
+		p := defaultQueryParameters()
+		p.Variables = map[string]interface{}{"a": a, "b": b}
+		if c != nil {
+			p.Variables["c"] = c
+		}
+		p.AdhocFilters = filters
+		return p
+	}
+
+	distinct := []struct {
+		name   string
+		first  QueryParameters
+		second QueryParameters
+	}{
+		{"separator in a value", params("1|b=2", "3", nil), params("1", "2|b=3", nil)},
+		{"list and its string form", params("x", "y", []interface{}{"x", "y"}), params("x", "y", "[x y]")},
+		{"number and string", params(float64(1), "y", nil), params("1", "y", nil)},
+		{"adhoc operator and value", params("x", "y", nil, AdhocCondition{Column: "x", Operator: "<", Value: "=5"}),
+			params("x", "y", nil, AdhocCondition{Column: "x", Operator: "<=", Value: "5"})},
+		{"missing and empty variable", params("x", "y", nil), params("x", "y", "")},
+	}
+	for _, test := range distinct {
+		t.Run(test.name, func(t *testing.T) {
+			if test.first.cacheKey(queryString) == test.second.cacheKey(queryString) {
+				t.Fatalf("parameters share the key %s", test.first.cacheKey(queryString))
+			}
+		})
+	}
+
+	// the scheduler loads the entry of a query without parameters under the empty key
+	if key := params("1", "2", nil).cacheKey("select 1"); key != "" {
+		t.Fatalf("query without parameters has the key %q", key)
+	}
+
+	// only what the query string references is part of the key
+	first, second := params("1", "2", nil), params("1", "other", nil)
+	second.TimeRange = TimeRange{RawFrom: "now-1h", RawTo: "now"}
+	if first.cacheKey("select $a") != second.cacheKey("select $a") {
+		t.Fatal("unreferenced variables and time range changed the key")
+	}
+	if first.cacheKey("select $a, $__timeFrom") == second.cacheKey("select $a, $__timeFrom") {
+		t.Fatal("the time range isn't part of the key of a query using it")
+	}
+	if first.cacheKey("select v$b") != second.cacheKey("select v$b") {
+		t.Fatal("a $ in an identifier changed the key")
+	}
+}
+
+func TestTimeRangeCacheKeyIsUnique(t *testing.T) {
+	first := TimeRange{RawFrom: "now-1h|now", RawTo: "now"}
+	second := TimeRange{RawFrom: "now-1h", RawTo: "now|now"}
+	if first.cacheKey() == second.cacheKey() {
+		t.Fatalf("ranges share the key %s", first.cacheKey())
+	}
+}
@@ -1,363 +1,296 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
-
-	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/godror/godror"
-	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 type Query struct {
-	Name            string   `json:"name"`
-	DatabaseName    string   `json:"database_name"`
-	QueryString     string   `json:"query_string"`
-	RefreshTime     int      `json:"refresh_time"`
-	ColumnList      []string `json:"column_list"`
-	RowList         []string `json:"row_list"`
-	lastRefreshTime time.Time
-	Locker          uint32 // locker is used with atomic operation to control updating lastDatablock
-	lastDatablock   Datablock
+	Name         string   `json:"name"`
+	DatabaseName string   `json:"database_name"`
+	QueryString  string   `json:"query_string"`
+	RefreshTime  int      `json:"refresh_time"` // seconds between refreshes, defaults to 60
+	ColumnList   []string `json:"column_list"`
+	RowList      []string `json:"row_list"`
+	Timeout      int      `json:"timeout"`       // seconds a refresh may run before it is cancelled, defaults to 120
+	MaxStaleness int      `json:"max_staleness"` // seconds a failing query's previous results are served for, 0 is no limit
+	cacheLock    sync.Mutex
+	cache        map[string]*QueryCacheEntry // keyed by the query parameters the query was run with
+	preloaded    bool                        // the scheduler created the entry of the query without parameters
 }
 
-type DataSelector struct {
-	Name             string            `json:"name"`
-	QueryName        string            `json:"query_name"`
-	RuleSet          DataSelectorRules `json:"rules"`
-	currentDataBlock Datablock
+// used for a query whose cfg doesn't set a timeout
+const defaultQueryTimeout = 120 * time.Second
+
+// used for a query whose cfg doesn't set a refresh_time
+const defaultRefreshTime = 60 * time.Second
+
+func (v *Query) refreshInterval() time.Duration {
+	if v.RefreshTime <= 0 {
+		return defaultRefreshTime
+	}
+	return time.Duration(v.RefreshTime) * time.Second
 }
 
-func (w *DataSelector) CurrentDataBlock() Datablock {
-	return w.currentDataBlock
+func (v *Query) timeout() time.Duration {
+	if v.Timeout <= 0 {
+		return defaultQueryTimeout
+	}
+	return time.Duration(v.Timeout) * time.Second
 }
 
-func (w *DataSelector) SetCurrentDataBlock(currentDataBlock Datablock) {
-	w.currentDataBlock = currentDataBlock
+type DataSelector struct {
+	Name           string            `json:"name"`
+	QueryName      string            `json:"query_name"`
+	RuleSet        DataSelectorRules `json:"rules"`
+	AllowedClients []string          `json:"allowed_clients"` // names of the clients that may use the dataselector
+	AllowedRoles   []string          `json:"allowed_roles"`   // roles of the clients that may use the dataselector, both empty is everyone
 }
 
 type Datablock struct {
 	Title       string                `json:"title"`
 	ColumnList  []string              `json:"column_list"`
+	ColumnTypes []string              `json:"column_types"` // number, time or string for each column
 	RowList     []string              `json:"row_list"`
 	Rowdata     map[int][]interface{} `json:"rowdata"`
 	UpdatedTime time.Time             `json:"updated_time"`
+	RefreshStatus
+	multiSeries bool // shaped by a seriesrule, every column after the time is a series
 }
 
-type DbConfig struct {
-	Name   string `json:"name"`
-	DBType string `json:"db_type"`
-}
-
-type OracleSIDConfig struct {
-	Name     string `json:"name"`
-	DBType   string `json:"db_type"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	SIDName  string `json:"sid_name"`
-}
-
-func (cfg OracleSIDConfig) connectionString() string {
-	return fmt.Sprintf("%s/%s@(DESCRIPTION=(ADDRESS_LIST=(ADDRESS="+
-		"(PROTOCOL=tcp)(HOST=%s)(PORT=%d)))(CONNECT_DATA=(SID=%s)))",
-		cfg.Username, cfg.Password, cfg.Host, cfg.Port, cfg.SIDName)
-}
-
-type PostgresConfig struct {
-	Name     string `json:"name"`
-	DBType   string `json:"db_type"`
-	DBName   string `json:"db_name"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-}
-
-func (cfg PostgresConfig) connectionString() string {
-	return fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		cfg.Host, cfg.Port, cfg.Username, cfg.Password, cfg.DBName)
+// RefreshStatus is how the latest refresh of a datablock's query went, when it failed the previous (stale)
+// result is served with the error
+type RefreshStatus struct {
+	Stale           bool      `json:"stale"`
+	LastError       string    `json:"last_error,omitempty"`
+	LastSuccessTime time.Time `json:"last_success_time"`
 }
 
-type MySQLConfig struct {
-	Name     string `json:"name"`
-	DBType   string `json:"db_type"`
-	DBName   string `json:"db_name"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
+type DbConfig struct {
+	Name                  string `json:"name"`
+	DBType                string `json:"db_type"`
+	MaxConcurrentQueries  int    `json:"max_concurrent_queries"`  // how many queries may refresh at once, defaults to 2
+	MaxOpenConnections    int    `json:"max_open_connections"`    // 0 is unlimited
+	MaxIdleConnections    int    `json:"max_idle_connections"`    // 0 is the database/sql default (2)
+	ConnectionMaxLifetime int    `json:"connection_max_lifetime"` // seconds, 0 is connections are reused forever
+	HealthCheckInterval   int    `json:"health_check_interval"`   // seconds between pings, defaults to 30
 }
 
-func (cfg MySQLConfig) connectionString() string {
-	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s",
-		cfg.Username, cfg.Password, cfg.Host, cfg.Port, cfg.DBName)
+// Database is an opened sql.DB along with the db type it was created for (used to pick the bind placeholder style)
+type Database struct {
+	Name                string
+	DBType              string
+	DB                  *sql.DB
+	configJSON          []byte        // the cfg/db json the database was opened from, used to detect changes on reload
+	refreshSlots        chan struct{} // one buffered value per query allowed to refresh on the database at once
+	healthCheckInterval time.Duration
+	health              DatabaseHealth
+	secrets             []Secret // the resolved credentials, redacted from errors reported about the database
+	refreshesLock       sync.Mutex
+	runningRefreshes    int  // refreshes started on the database that haven't finished
+	closing             bool // removed by a reload, closed once the running refreshes finish
 }
 
-var dbMap = make(map[string]*sql.DB)
-var queryMap = make(map[string]*Query)
-var dataSelectorMap = make(map[string]*DataSelector)
-var dataSelectorToQueryMap = make(map[string]*Query)
-
 func main() {
-
-	// read the cfg/db folder and create db instances for the json files
-	const cfgPathDB = "./cfg/db/"
-	dbFiles, err := ioutil.ReadDir(cfgPathDB)
+	serverCfg, args, err := parseServerConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
+	}
+	if err := configureLogging(serverCfg.LogLevel, serverCfg.LogFormat); err != nil {
+		logger.Fatal(err)
 	}
 
-	// use the db json files and create the different sql.Db into the dbMap
-	for _, file := range dbFiles {
-		queryFile, err := os.Open(cfgPathDB + file.Name())
-		if err != nil {
-			fmt.Println(err)
+	if len(args) > 0 {
+		if args[0] != "validate" {
+			logger.Fatal("Unknown command ", args[0])
 		}
-		defer queryFile.Close()
-
-		var jsonData []byte
-		jsonData, err = ioutil.ReadAll(queryFile)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		var genericDB DbConfig
-		json.Unmarshal(jsonData, &genericDB)
-
-		if genericDB.DBType == "oracle" {
-			var oracleDB OracleSIDConfig
-
-			json.Unmarshal(jsonData, &oracleDB)
-
-			db, err := sql.Open("godror", oracleDB.connectionString())
-
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			defer db.Close()
-
-			err = db.Ping()
-			if err != nil {
-				fmt.Println(err)
-			}
-
-			dbMap[oracleDB.Name] = db
-		} else if genericDB.DBType == "postgres" {
-			var postgresDB PostgresConfig
-
-			json.Unmarshal(jsonData, &postgresDB)
-
-			db, err := sql.Open("postgres", postgresDB.connectionString())
-
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			defer db.Close()
+		os.Exit(runValidateCommand(serverCfg.CfgRoot))
+	}
 
-			err = db.Ping()
-			if err != nil {
-				fmt.Println(err)
-			}
+	cfg, problems, err := loadConfig(serverCfg.CfgRoot, nil)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logConfigProblems(problems)
+	if serverCfg.Strict && len(problems) > 0 {
+		logger.Fatal("Not starting, the cfg has ", len(problems), " problems and strict is set")
+	}
+	setCurrentConfig(cfg)
+	if len(cfg.clientMap) == 0 && !serverCfg.AllowAnonymous {
+		logger.Warn("No clients in " + filepath.Join(serverCfg.CfgRoot, cfgFolderClient) +
+			", every request will be rejected until one is added or allow_anonymous is set")
+	}
 
-			dbMap[postgresDB.Name] = db
-		} else if genericDB.DBType == "mysql" {
-			var mysqlDB MySQLConfig
+	if err := runServer(serverCfg); err != nil {
+		logger.Fatal(err)
+	}
+}
 
-			json.Unmarshal(jsonData, &mysqlDB)
+// returns the query's cached datablock for the parameters. The scheduler keeps the cache up to date so
+// the only time this runs the query is the first request for a set of parameters, the return bool is if
+// the data was updated (loaded) or not
+// queries using macros or variables are cached separately for each set of values they are bound with
+// the context bounds how long the first request waits for the data to load
+func getDatablockAndUpdateIfNeeded(ctx context.Context, db *Database, v *Query, params QueryParameters) (Datablock, error, bool) {
 
-			db, err := sql.Open("mysql", mysqlDB.connectionString())
+	entry := v.cacheEntry(params.cacheKey(v.QueryString), params)
 
-			if err != nil {
-				fmt.Println(err)
-				return
+	if snapshot, refreshStatus := entry.snapshot(); snapshot != nil {
+		if refreshStatus.Stale {
+			queryCacheRequests.WithLabelValues(v.Name, "stale").Inc()
+		} else {
+			queryCacheRequests.WithLabelValues(v.Name, "hit").Inc()
+		}
+		if refreshStatus.Stale && v.MaxStaleness > 0 {
+			maxStaleness := time.Duration(v.MaxStaleness) * time.Second
+			staleFor := time.Since(refreshStatus.LastSuccessTime)
+			if staleFor > maxStaleness {
+				return Datablock{}, fmt.Errorf("no successful refresh since %s, last error: %s",
+					refreshStatus.LastSuccessTime.Format(time.RFC3339), refreshStatus.LastError), false
 			}
-			defer db.Close()
-
-			err = db.Ping()
-			if err != nil {
-				fmt.Println(err)
+			// the last quarter of max_staleness, requests are about to start failing
+			if staleFor > maxStaleness*3/4 {
+				requestLogger(ctx).WithFields(logrus.Fields{
+					"query":             v.Name,
+					"last_success_time": refreshStatus.LastSuccessTime.Format(time.RFC3339),
+					"last_error":        refreshStatus.LastError,
+				}).Warn("Serving stale results close to the query's max_staleness")
 			}
-
-			dbMap[mysqlDB.Name] = db
-		} else {
-			fmt.Println("Unknown db type ", genericDB.DBType)
 		}
+		datablock := *snapshot
+		datablock.RefreshStatus = refreshStatus
+		return datablock, nil, false
 	}
 
-	// read the cfg/query folder and load all the query json files
-	const cfgPathQuery = "./cfg/query/"
-	queryFiles, err := ioutil.ReadDir(cfgPathQuery)
+	queryCacheRequests.WithLabelValues(v.Name, "miss").Inc()
+	datablock, err := entry.refresh(ctx, db, v)
 	if err != nil {
-		log.Fatal(err)
+		return Datablock{}, err, false
 	}
+	return *datablock, nil, true
+}
 
-	for _, file := range queryFiles {
-		queryFile, err := os.Open(cfgPathQuery + file.Name())
-		if err != nil {
-			fmt.Println(err)
-		}
-		defer queryFile.Close()
-
-		var jsonData []byte
-		jsonData, err = ioutil.ReadAll(queryFile)
-		if err != nil {
-			fmt.Println(err)
-		}
+// runs the query with the parameters and returns its results as a datablock
+func runQuery(ctx context.Context, db *Database, v *Query, params QueryParameters) (Datablock, error) {
+	var result Datablock
 
-		var query Query
-		json.Unmarshal(jsonData, &query)
-		queryMap[query.Name] = &query
+	queryString, queryArgs := expandQueryString(v.QueryString, db.DBType, params)
 
-		//fmt.Println(query.Name, query.DatabaseName, query.QueryString, query.ColumnList)
+	var allResults = make(map[int][]interface{})
+	rows, err := db.DB.QueryContext(ctx, queryString, queryArgs...)
+	if err != nil {
+		return result, err
 	}
-
-	// read the cfg/dataselector folder and load all the dataselector json files
-	const cfgPathDataSelector = "./cfg/dataselector/"
-	dataSelectorFiles, err := ioutil.ReadDir(cfgPathDataSelector)
+	defer rows.Close()
+	cols, err := rows.Columns()
 	if err != nil {
-		log.Fatal(err)
+		return result, err
 	}
-
-	for _, file := range dataSelectorFiles {
-		dataSelectorFile, err := os.Open(cfgPathDataSelector + file.Name())
-		if err != nil {
-			fmt.Println(err)
-		}
-		defer dataSelectorFile.Close()
-
-		var jsonData []byte
-		jsonData, err = ioutil.ReadAll(dataSelectorFile)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		var dSelector DataSelector
-		err = json.Unmarshal(jsonData, &dSelector)
-		if err != nil {
-			fmt.Println("Error during processing ", dataSelectorFile, " error: ", err)
-			continue
-		}
-		dataSelectorMap[dSelector.Name] = &dSelector
-
-		query, found := queryMap[dSelector.QueryName]
-
-		if found == false {
-			fmt.Println("Could not find query in query map ", dSelector.QueryName)
-		} else {
-			dataSelectorToQueryMap[dSelector.Name] = query
-		}
-
+	sqlColumnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return result, err
 	}
-
-	http.ListenAndServe(":9999", registerRoutes())
-}
-
-// if current time minus last time (all in seconds) is greater than the refreshtime (refresh limiter) then update
-// the data block otherwise return the queries last datablock. Return bool is if the data was updated or not
-func getDatablockAndUpdateIfNeeded(db *sql.DB, v *Query) (Datablock, error, bool) {
-
-	timeSinceLastRefresh := time.Now().Unix() - v.lastRefreshTime.Unix()
-	if timeSinceLastRefresh > int64(v.RefreshTime) {
-		// atomically check if the value of locker is 0 and if so change it to 1 (locked)
-		// if that is is false then return the older data as if it wasn't time to refresh
-		// as another process is updating this query currently
-		if !atomic.CompareAndSwapUint32(&v.Locker, 0, 1) {
-			return v.lastDatablock, nil, false
+	columnTypes := make([]string, len(sqlColumnTypes))
+	for i, sqlColumnType := range sqlColumnTypes {
+		columnTypes[i] = columnTypeFromSQL(sqlColumnType)
+	}
+	rowCount := 0
+	for rows.Next() {
+		// Create a slice of interface{}'s to represent each column,
+		// and a second slice to contain pointers to each item in the columns slice.
+		columns := make([]interface{}, len(cols))
+		columnPointers := make([]interface{}, len(cols))
+		rowCount = rowCount + 1
+
+		for i, _ := range columns {
+			columnPointers[i] = &columns[i]
 		}
-		defer atomic.StoreUint32(&v.Locker, 0)
-
-		var result Datablock
 
-		var allResults = make(map[int][]interface{})
-		rows, err := db.Query(v.QueryString)
+		// Scan the result into the column pointers...
+		err := rows.Scan(columnPointers...)
 		if err != nil {
-			return result, err, false
+			return result, err
 		}
-		defer rows.Close()
-		cols, err := rows.Columns()
-		if err != nil {
-			return result, err, false
+		for i := range columns {
+			columns[i] = normalizeValue(columns[i], columnTypes[i])
 		}
-		rowCount := 0
-		for rows.Next() {
-			// Create a slice of interface{}'s to represent each column,
-			// and a second slice to contain pointers to each item in the columns slice.
-			columns := make([]interface{}, len(cols))
-			columnPointers := make([]interface{}, len(cols))
-			rowCount = rowCount + 1
-
-			for i, _ := range columns {
-				columnPointers[i] = &columns[i]
-			}
-
-			// Scan the result into the column pointers...
-			err := rows.Scan(columnPointers...)
-			if err != nil {
-				return result, err, false
-			}
 
-			allResults[rowCount] = columns
-		}
-
-		datablock := Datablock{
-			Title:       v.Name,
-			ColumnList:  v.ColumnList,
-			RowList:     v.RowList,
-			Rowdata:     allResults,
-			UpdatedTime: time.Now(),
-		}
-
-		v.lastDatablock = datablock
-		v.lastRefreshTime = time.Now()
-		return datablock, nil, true
-	} else {
-		return v.lastDatablock, nil, false
+		allResults[rowCount] = columns
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
 	}
 
+	return Datablock{
+		Title:       v.Name,
+		ColumnList:  v.ColumnList,
+		ColumnTypes: columnTypes,
+		RowList:     v.RowList,
+		Rowdata:     allResults,
+		UpdatedTime: time.Now(),
+	}, nil
 }
 
-func registerRoutes() http.Handler {
+func registerRoutes(serverCfg ServerConfig) http.Handler {
 	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Use(requestLoggingMiddleware)
+	router.Use(recoverMiddleware)
+	router.Use(metricsMiddleware)
 
-	// Basic CORS
-	// for more ideas, see: https://developer.github.com/v3/#cross-origin-resource-sharing
-	cors := cors.New(cors.Options{
-		// AllowedOrigins: []string{"https://foo.com"}, // Use this to allow specific origin hosts
-		AllowedOrigins: []string{"*"},
-		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300, // Maximum value not ignored by any of major browsers
-	})
+	// serverCfg.CORS is the cors policy of the cors_profile with the defaults filled in
+	cors := cors.New(serverCfg.CORS.options())
 	router.Use(cors.Handler)
-
-	router.Get("/dataselector/{dataSelectorName}", getDataSelectorHandler)
-	router.Get("/dataselectordata/{dataSelectorName}", getDataSelectorDataHandler)
-	router.Get("/query/{queryName}", getQueryHandler)
-	router.Get("/", getRoot)
-
-	router.Post("/search", postSearchHandler)
-	router.Post("/query", postQueryHandler)
+	// after cors so preflight requests (which carry no credentials) are answered, and in a group so it runs
+	// once the request is routed and the metrics label a rejected request with its route
+	router.Group(func(router chi.Router) {
+		router.Use(authMiddleware(serverCfg.AllowAnonymous))
+
+		router.Get("/dataselector/{dataSelectorName}", getDataSelectorHandler)
+		router.Get("/dataselectordata/{dataSelectorName}", getDataSelectorDataHandler)
+		router.Get("/query/{queryName}", getQueryHandler)
+		router.Get("/", getRoot)
+
+		router.Group(func(router chi.Router) {
+			router.Use(requireAdmin)
+			router.Post("/admin/reload", postAdminReloadHandler(serverCfg.Strict))
+			router.Get("/status/query", getQueryStatusListHandler)
+			router.Get("/status/query/{queryName}", getQueryStatusHandler)
+			router.Get("/health/db", getDatabaseHealthHandler)
+			router.Method(http.MethodGet, "/metrics", promhttp.Handler())
+		})
+
+		router.Post("/search", postSearchHandler)
+		router.Post("/query", postQueryHandler)
+		router.Post("/variable", postVariableHandler)
+		router.Post("/tag-keys", postTagKeysHandler)
+		router.Post("/tag-values", postTagValuesHandler)
+		router.Post("/annotations", postAnnotationsHandler)
+		// the json datasource's metric list, GET /metrics (admin only) is the prometheus metrics
+		router.Post("/metrics", postMetricsHandler)
+		router.Post("/metric-payload-options", postMetricPayloadOptionsHandler)
+	})
 
 	return router
 }
@@ -366,81 +299,83 @@ func postQueryHandler(writer http.ResponseWriter, request *http.Request) {
 
 	body, err := ioutil.ReadAll(request.Body)
 	if err != nil {
-		log.Fatal(err)
+		requestLogger(request.Context()).WithError(err).Warn("Could not read /query request body")
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	grafanaQueryRequest, err := UnmarshalGrafanaQueryRequest(body)
+	if err != nil {
+		http.Error(writer, "Invalid query request json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := grafanaQueryRequest.validate(); err != nil {
+		http.Error(writer, "Invalid query request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	var requestedDataSelectorNames []string
-	for i := range grafanaQueryRequest.Targets {
-		requestedDataSelectorNames = append(requestedDataSelectorNames, grafanaQueryRequest.Targets[i].Target)
+	params, err := queryParametersFromGrafanaRequest(grafanaQueryRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
 	}
-	dataSelectorOutputType := grafanaQueryRequest.Targets[0].Type
 
-	if dataSelectorOutputType == "table" {
-		responseJson, httpCode, errorString := convertDataSelectorToGrafanaTable(requestedDataSelectorNames)
+	responseJson, httpCode, errorString := convertTargetsToGrafanaResponse(request.Context(), grafanaQueryRequest.Targets, params)
 
-		if errorString != "" {
-			http.Error(writer, errorString, httpCode)
-		} else {
-			writer.Header().Set("Content-Type", "application/json")
-			writer.WriteHeader(httpCode)
-			writer.Write(responseJson)
-		}
+	if errorString != "" {
+		http.Error(writer, errorString, httpCode)
 	} else {
-		responseJson, httpCode, errorString := convertDataSelectorToGrafanaTimeSeries(requestedDataSelectorNames)
-
-		if errorString != "" {
-			http.Error(writer, errorString, httpCode)
-		} else {
-			writer.Header().Set("Content-Type", "application/json")
-			writer.WriteHeader(httpCode)
-			writer.Write(responseJson)
-		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(httpCode)
+		writer.Write(responseJson)
 	}
-
 }
 
-func convertDataSelectorToGrafanaTable(dataSelectorNames []string) ([]byte, int, string) {
-	var grafanaRsp GrafanaTableQueryResponse
-
-	for i := range dataSelectorNames {
+// returns the response for the targets in the order requested, each rendered as its own type
+// (table, timeserie or frame). Hidden targets are skipped, the payload values of a target are variables
+// of its query on top of the request's
+func convertTargetsToGrafanaResponse(ctx context.Context, targets []Target, params QueryParameters) ([]byte, int, string) {
+	grafanaRsp := []interface{}{}
 
-		dataSelectorName := dataSelectorNames[i]
-
-		_, httpCode, errorString := getDataSelectorData(dataSelectorName)
+	for _, target := range targets {
+		if target.Hide {
+			continue
+		}
 
+		payload, _ := target.payload()
+		datablock, httpCode, errorString := getDataSelectorDataBlock(ctx, target.Target, params.withVariables(payloadVariables(payload)))
 		if httpCode != http.StatusOK {
-			return nil, httpCode, errorString
+			return nil, httpCode, "Target " + target.RefID + ": " + errorString
 		}
 
-		dSelector, found := dataSelectorMap[dataSelectorName]
-		if found != true {
-			return nil, http.StatusNotFound, "Could not find dataselector in dataselector map " + dataSelectorName
-		} else {
-			var grafanaRspElement GrafanaTableQueryResponseElement
-
-			dblockCols := dSelector.currentDataBlock.ColumnList
-
-			for i, _ := range dblockCols {
-				var rspCol GrafanaTableQueryResponseColumn
-				rspCol.Text = dblockCols[i]
-				rspCol.Type = "string"
-				grafanaRspElement.Columns = append(grafanaRspElement.Columns, rspCol)
+		// stale results (the latest refresh failed) are marked in the meta so grafana shows a warning
+		meta := staleResponseMeta(datablock.RefreshStatus)
+		switch target.format(payload) {
+		case "table":
+			grafanaRspElement := convertDataBlockToGrafanaTable(datablock)
+			grafanaRspElement.RefID = target.RefID
+			grafanaRspElement.Meta = meta
+			grafanaRsp = append(grafanaRsp, grafanaRspElement)
+		case "frame":
+			grafanaRspElement := convertDataBlockToGrafanaDataFrame(datablock)
+			grafanaRspElement.Name = target.Target
+			grafanaRspElement.RefID = target.RefID
+			grafanaRspElement.Meta = meta
+			grafanaRsp = append(grafanaRsp, grafanaRspElement)
+		default:
+			grafanaRspElements, err := convertDataBlockToGrafanaTimeSeries(datablock)
+			if err != nil {
+				return nil, http.StatusBadRequest, "Target " + target.RefID + ": dataselector " + target.Target +
+					" can't be shown as a time series: " + err.Error()
 			}
-
-			dblockRows := dSelector.currentDataBlock.Rowdata
-
-			for _, k := range sortedKeysForDataBlockData(dblockRows) {
-				grafanaRspElement.Rows = append(grafanaRspElement.Rows, dblockRows[k])
+			for _, grafanaRspElement := range grafanaRspElements {
+				grafanaRspElement.RefID = target.RefID
+				grafanaRspElement.Meta = meta
+				grafanaRsp = append(grafanaRsp, grafanaRspElement)
 			}
-
-			grafanaRspElement.Type = "table"
-
-			grafanaRsp = append(grafanaRsp, grafanaRspElement)
-
 		}
 	}
+
 	response, err := json.Marshal(grafanaRsp)
 	if err == nil {
 		return response, http.StatusOK, ""
@@ -449,55 +384,148 @@ func convertDataSelectorToGrafanaTable(dataSelectorNames []string) ([]byte, int,
 	}
 }
 
-func convertDataSelectorToGrafanaTimeSeries(dataSelectorNames []string) ([]byte, int, string) {
+// the meta of a response element of stale results, nil if the results are fresh
+func staleResponseMeta(refreshStatus RefreshStatus) *GrafanaResponseMeta {
+	if !refreshStatus.Stale {
+		return nil
+	}
+	return &GrafanaResponseMeta{
+		RefreshStatus: refreshStatus,
+		Notices: []GrafanaNotice{{
+			Severity: "warning",
+			Text: "Stale data, the query last refreshed at " + refreshStatus.LastSuccessTime.Format(time.RFC3339) +
+				": " + refreshStatus.LastError,
+		}},
+	}
+}
+
+func convertDataBlockToGrafanaTable(datablock Datablock) GrafanaTableQueryResponseElement {
+	var grafanaRspElement GrafanaTableQueryResponseElement
 
-	var grafanaRsp GrafanaTimeSeriesQueryResponse
+	dblockCols := datablock.ColumnList
 
-	for i := range dataSelectorNames {
+	for i, _ := range dblockCols {
+		var rspCol GrafanaTableQueryResponseColumn
+		rspCol.Text = dblockCols[i]
+		rspCol.Type = datablock.columnType(i)
+		grafanaRspElement.Columns = append(grafanaRspElement.Columns, rspCol)
+	}
 
-		dataSelectorName := dataSelectorNames[i]
-		_, httpCode, errorString := getDataSelectorData(dataSelectorName)
+	dblockRows := datablock.Rowdata
 
-		if httpCode != http.StatusOK {
-			return nil, httpCode, errorString
+	grafanaRspElement.Rows = [][]interface{}{}
+	for _, k := range sortedKeysForDataBlockData(dblockRows) {
+		row := make([]interface{}, len(dblockRows[k]))
+		for i, value := range dblockRows[k] {
+			row[i] = grafanaTableValue(value)
 		}
+		grafanaRspElement.Rows = append(grafanaRspElement.Rows, row)
+	}
 
-		dSelector, found := dataSelectorMap[dataSelectorName]
-		if found != true {
-			return nil, http.StatusNotFound, "Could not find dataselector in dataselector map " + dataSelectorName
-		} else {
+	grafanaRspElement.Type = "table"
+	return grafanaRspElement
+}
 
-			var grafanaRspElement GrafanaTimeSeriesQueryResponseElement
+// the datablock as a data frame, a field per column with the column's values in row order
+func convertDataBlockToGrafanaDataFrame(datablock Datablock) GrafanaDataFrame {
+	grafanaRspElement := GrafanaDataFrame{Fields: make([]GrafanaDataFrameField, len(datablock.ColumnList))}
+	for i := range datablock.ColumnList {
+		grafanaRspElement.Fields[i] = GrafanaDataFrameField{
+			Name:   datablock.ColumnList[i],
+			Type:   datablock.columnType(i),
+			Values: []interface{}{},
+		}
+	}
 
-			dblockRows := dSelector.currentDataBlock.Rowdata
+	dblockRows := datablock.Rowdata
+	for _, k := range sortedKeysForDataBlockData(dblockRows) {
+		for i := range grafanaRspElement.Fields {
+			grafanaRspElement.Fields[i].Values = append(grafanaRspElement.Fields[i].Values, grafanaTableValue(rowValue(dblockRows[k], i)))
+		}
+	}
+	return grafanaRspElement
+}
 
-			for _, k := range sortedKeysForDataBlockData(dblockRows) {
-				datapointTime := dblockRows[k][0].(time.Time)
-				datapointMetric := dblockRows[k][1]
+// the datablock's rows as datapoints, the first column is the time and the second the metric, named by its
+// column header. A datablock shaped by a seriesrule has a series for every column after the time, their
+// empty (nil) values are left out as a series has no value at the times of the other series
+func convertDataBlockToGrafanaTimeSeries(datablock Datablock) ([]GrafanaTimeSeriesQueryResponseElement, error) {
+	if len(datablock.ColumnList) < 2 {
+		return nil, fmt.Errorf("columns %v, a time and at least one metric column are needed", datablock.ColumnList)
+	}
 
-				datapointEpocTime := datapointTime.UnixNano() / 1000000
+	seriesCount := 1
+	if datablock.multiSeries {
+		seriesCount = len(datablock.ColumnList) - 1
+	}
+	grafanaRspElements := make([]GrafanaTimeSeriesQueryResponseElement, seriesCount)
+	for i := range grafanaRspElements {
+		grafanaRspElements[i].Target = datablock.ColumnList[i+1]
+		grafanaRspElements[i].Datapoints = [][]interface{}{}
+	}
 
-				datapoint := []interface{}{datapointMetric, datapointEpocTime}
-				grafanaRspElement.Datapoints = append(grafanaRspElement.Datapoints, datapoint)
+	dblockRows := datablock.Rowdata
 
+	// rows with an empty or unparsable time are left out, it is only an error if no row has a time
+	timedRows := 0
+	var notATime interface{} // the first time column value that isn't empty and isn't a time
+	for _, k := range sortedKeysForDataBlockData(dblockRows) {
+		datapointTime, ok := timeFromValue(rowValue(dblockRows[k], 0))
+		if !ok {
+			if notATime == nil {
+				notATime = rowValue(dblockRows[k], 0)
 			}
+			continue
+		}
+		timedRows++
+		datapointEpocTime := datapointTime.UnixNano() / 1000000
 
-			grafanaRsp = append(grafanaRsp, grafanaRspElement)
+		for i := range grafanaRspElements {
+			value := rowValue(dblockRows[k], i+1)
+			if value == nil && datablock.multiSeries {
+				continue
+			}
+			datapoint := []interface{}{value, datapointEpocTime}
+			grafanaRspElements[i].Datapoints = append(grafanaRspElements[i].Datapoints, datapoint)
 		}
 	}
-	response, err := json.Marshal(grafanaRsp)
-	if err == nil {
-		return response, http.StatusOK, ""
-	} else {
-		return nil, http.StatusInternalServerError, err.Error()
+	if timedRows == 0 && notATime != nil {
+		return nil, fmt.Errorf("the first column is a %T, not a time", notATime)
 	}
+
+	return grafanaRspElements, nil
 }
 
+// a target naming a variable returns the variable's values, otherwise the dataselector names are listed
 func postSearchHandler(writer http.ResponseWriter, request *http.Request) {
 
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// an empty body is a plain metric search so an unparsable body is treated the same way
+	var searchRequest GrafanaSearchRequest
+	json.Unmarshal(body, &searchRequest)
+
+	cfg := currentConfig()
+	if _, found := cfg.variableMap[searchRequest.Target]; found {
+		values, httpCode, errorString := getVariableValues(request.Context(), searchRequest.Target, defaultQueryParameters())
+		if errorString != "" {
+			http.Error(writer, errorString, httpCode)
+		} else {
+			writeJSONResponse(writer, values)
+		}
+		return
+	}
+
+	client := clientFromContext(request.Context())
 	var dataSelectorNames []string
-	for key, _ := range dataSelectorMap {
-		dataSelectorNames = append(dataSelectorNames, key)
+	for key, dSelector := range cfg.dataSelectorMap {
+		if client.canAccessDataSelector(dSelector) {
+			dataSelectorNames = append(dataSelectorNames, key)
+		}
 	}
 	responseJSON, err := json.Marshal(dataSelectorNames)
 
@@ -518,7 +546,7 @@ func getRoot(writer http.ResponseWriter, request *http.Request) {
 func getDataSelectorHandler(w http.ResponseWriter, r *http.Request) {
 	dataSelectorName := chi.URLParam(r, "dataSelectorName")
 
-	responseJson, httpCode, errorString := getDataSelector(dataSelectorName)
+	responseJson, httpCode, errorString := getDataSelector(r.Context(), dataSelectorName)
 
 	if errorString != "" {
 		http.Error(w, errorString, httpCode)
@@ -533,11 +561,13 @@ func getDataSelectorHandler(w http.ResponseWriter, r *http.Request) {
 // json of dataselector requested or nil if error
 // http status code to use in rsp
 // error string to pass back if error
-func getDataSelector(dataSelectorName string) ([]byte, int, string) {
-	requestedDataSelector, found := dataSelectorMap[dataSelectorName]
+func getDataSelector(ctx context.Context, dataSelectorName string) ([]byte, int, string) {
+	requestedDataSelector, found := currentConfig().dataSelectorMap[dataSelectorName]
 
 	if found != true {
 		return nil, http.StatusNotFound, "Could not find dataselector in dataselector map " + dataSelectorName
+	} else if httpCode, errorString := checkDataSelectorAccess(ctx, requestedDataSelector); errorString != "" {
+		return nil, httpCode, errorString
 	} else {
 		response, err := json.Marshal(requestedDataSelector)
 		if err == nil {
@@ -567,7 +597,7 @@ func getQueryHandler(w http.ResponseWriter, r *http.Request) {
 // http status code to use in rsp
 // error string to pass back if error
 func getQuery(queryName string) ([]byte, int, string) {
-	requestedQuery, found := queryMap[queryName]
+	requestedQuery, found := currentConfig().queryMap[queryName]
 
 	if found != true {
 		return nil, http.StatusNotFound, "Could not find query in query map " + queryName
@@ -584,7 +614,13 @@ func getQuery(queryName string) ([]byte, int, string) {
 func getDataSelectorDataHandler(w http.ResponseWriter, r *http.Request) {
 	dataSelectorName := chi.URLParam(r, "dataSelectorName")
 
-	responseJson, httpCode, errorString := getDataSelectorData(dataSelectorName)
+	params, err := queryParametersFromURL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	responseJson, httpCode, errorString := getDataSelectorData(r.Context(), dataSelectorName, params)
 
 	if errorString != "" {
 		http.Error(w, errorString, httpCode)
@@ -599,38 +635,62 @@ func getDataSelectorDataHandler(w http.ResponseWriter, r *http.Request) {
 // json of dataselector's datablock requested or nil if error
 // http status code to use in rsp
 // error string to pass back if error
-func getDataSelectorData(dataSelectorName string) ([]byte, int, string) {
-	dSelector, found := dataSelectorMap[dataSelectorName]
+func getDataSelectorData(ctx context.Context, dataSelectorName string, params QueryParameters) ([]byte, int, string) {
+	datablock, httpCode, errorString := getDataSelectorDataBlock(ctx, dataSelectorName, params)
+	if httpCode != http.StatusOK {
+		return nil, httpCode, errorString
+	}
+
+	response, err := json.Marshal(datablock)
+	if err == nil {
+		return response, http.StatusOK, ""
+	} else {
+		return nil, http.StatusInternalServerError, err.Error()
+	}
+}
+
+// returns
+// dataselector's datablock for the query parameters with the dataselector's rules applied
+// http status code to use in rsp
+// error string to pass back if error
+func getDataSelectorDataBlock(ctx context.Context, dataSelectorName string, params QueryParameters) (Datablock, int, string) {
+	cfg := currentConfig()
+	dSelector, found := cfg.dataSelectorMap[dataSelectorName]
 	if found != true {
-		return nil, http.StatusNotFound, "Could not find dataselector in dataselector map " + dataSelectorName
+		return Datablock{}, http.StatusNotFound, "Could not find dataselector in dataselector map " + dataSelectorName
+	} else if httpCode, errorString := checkDataSelectorAccess(ctx, dSelector); errorString != "" {
+		return Datablock{}, httpCode, errorString
 	} else {
-		query, found := queryMap[dSelector.QueryName]
+		query, found := cfg.queryMap[dSelector.QueryName]
 		if found != true {
-			return nil, http.StatusNotFound, "Could not find query in query map " + dSelector.QueryName
+			return Datablock{}, http.StatusNotFound, "Could not find query in query map " + dSelector.QueryName
 		} else {
-			db, found := dbMap[query.DatabaseName]
+			db, found := cfg.dbMap[query.DatabaseName]
 
 			if found == false {
-				return nil, http.StatusNotFound, "Could not find database in DB map " + query.DatabaseName
+				return Datablock{}, http.StatusNotFound, "Could not find database in DB map " + query.DatabaseName
 			} else {
-				datablock, err, dataUpdated := getDatablockAndUpdateIfNeeded(db, query)
+				datablock, err, _ := getDatablockAndUpdateIfNeeded(ctx, db, query, params)
 				if err != nil {
-					return nil, http.StatusInternalServerError, "Error getting results from query " + err.Error()
+					return Datablock{}, http.StatusInternalServerError, "Error getting results from query " + err.Error()
 				}
 
-				if dataUpdated {
-					for i := 0; i < len(dSelector.RuleSet.Rules); i++ {
-						datablock, _ = dSelector.RuleSet.Rules[i].ApplyRuleToDataBlock(datablock)
+				// the cached datablock is the raw query result (it is shared between query parameters and
+				// dataselectors) so the rules are applied on every request
+				refreshStatus := datablock.RefreshStatus
+				multiSeries := false
+				for i := 0; i < len(dSelector.RuleSet.Rules); i++ {
+					rule := dSelector.RuleSet.Rules[i]
+					if paramsRule, ok := rule.(queryParametersRule); ok {
+						rule = paramsRule.withQueryParameters(params)
 					}
-					dSelector.SetCurrentDataBlock(datablock)
+					datablock, _ = rule.ApplyRuleToDataBlock(datablock)
+					multiSeries = multiSeries || datablock.multiSeries
 				}
+				datablock.RefreshStatus = refreshStatus
+				datablock.multiSeries = multiSeries
 
-				response, err := json.Marshal(datablock)
-				if err == nil {
-					return response, http.StatusOK, ""
-				} else {
-					return nil, http.StatusInternalServerError, err.Error()
-				}
+				return datablock, http.StatusOK, ""
 			}
 		}
 	}
@@ -647,7 +707,7 @@ func sortedKeysForDataBlockData(m map[int][]interface{}) []int {
 	return keys
 }
 
-//*************Grafana query json stuff
+// *************Grafana query json stuff
 func UnmarshalGrafanaQueryRequest(data []byte) (GrafanaQueryRequest, error) {
 	var r GrafanaQueryRequest
 	err := json.Unmarshal(data, &r)
@@ -655,15 +715,16 @@ func UnmarshalGrafanaQueryRequest(data []byte) (GrafanaQueryRequest, error) {
 }
 
 type GrafanaQueryRequest struct {
-	Timezone      string     `json:"timezone"`
-	PanelID       int64      `json:"panelId"`
-	Range         Range      `json:"range"`
-	RangeRaw      Raw        `json:"rangeRaw"`
-	Interval      string     `json:"interval"`
-	IntervalMS    int64      `json:"intervalMs"`
-	Targets       []Target   `json:"targets"`
-	MaxDataPoints int64      `json:"maxDataPoints"`
-	ScopedVars    ScopedVars `json:"scopedVars"`
+	Timezone      string               `json:"timezone"`
+	PanelID       int64                `json:"panelId"`
+	Range         Range                `json:"range"`
+	RangeRaw      Raw                  `json:"rangeRaw"`
+	Interval      string               `json:"interval"`
+	IntervalMS    int64                `json:"intervalMs"`
+	Targets       []Target             `json:"targets"`
+	MaxDataPoints int64                `json:"maxDataPoints"`
+	ScopedVars    ScopedVars           `json:"scopedVars"`
+	AdhocFilters  []GrafanaAdhocFilter `json:"adhocFilters"`
 }
 
 type Range struct {
@@ -677,33 +738,54 @@ type Raw struct {
 	To   string `json:"to"`
 }
 
-type ScopedVars struct {
-	Interval   Interval   `json:"__interval"`
-	IntervalMS IntervalMS `json:"__interval_ms"`
-}
+// scoped variables by name, includes grafana's own __interval and __interval_ms
+type ScopedVars map[string]ScopedVar
 
-type Interval struct {
-	Text  string `json:"text"`
-	Value string `json:"value"`
-}
-
-type IntervalMS struct {
-	Text  int64 `json:"text"`
-	Value int64 `json:"value"`
+type ScopedVar struct {
+	Text  interface{} `json:"text"`
+	Value interface{} `json:"value"` // a list of values for multi value variables
 }
 
 type Target struct {
-	Target string `json:"target"`
-	RefID  string `json:"refId"`
-	Type   string `json:"type"`
+	Target  string          `json:"target"`
+	RefID   string          `json:"refId"`
+	Type    string          `json:"type"` // table or timeserie, timeserie if empty
+	Hide    bool            `json:"hide"`
+	Payload json.RawMessage `json:"payload"` // the json datasource's payload, see Target.payload
 }
 
-type GrafanaTableQueryResponse []GrafanaTableQueryResponseElement
+// checks the request has targets and that every target names a dataselector with a known type
+func (r GrafanaQueryRequest) validate() error {
+	if len(r.Targets) == 0 {
+		return errors.New("no targets")
+	}
+	for i, target := range r.Targets {
+		if target.Target == "" {
+			return fmt.Errorf("targets[%d] (refId %s) has no target dataselector", i, target.RefID)
+		}
+		payload, err := target.payload()
+		if err != nil {
+			return fmt.Errorf("targets[%d] (refId %s) has an invalid payload: %v", i, target.RefID, err)
+		}
+		if format := target.format(payload); !containsString(targetFormats, format) {
+			return fmt.Errorf("targets[%d] (refId %s) has unknown type %s, use table, timeserie or frame", i, target.RefID, format)
+		}
+	}
+	if r.MaxDataPoints < 0 {
+		return errors.New("maxDataPoints is negative")
+	}
+	if r.IntervalMS < 0 {
+		return errors.New("intervalMs is negative")
+	}
+	return nil
+}
 
 type GrafanaTableQueryResponseElement struct {
 	Columns []GrafanaTableQueryResponseColumn `json:"columns"`
 	Rows    [][]interface{}                   `json:"rows"`
 	Type    string                            `json:"type"`
+	RefID   string                            `json:"refId,omitempty"`
+	Meta    *GrafanaResponseMeta              `json:"meta,omitempty"`
 }
 
 type GrafanaTableQueryResponseColumn struct {
@@ -711,18 +793,52 @@ type GrafanaTableQueryResponseColumn struct {
 	Type string `json:"type"`
 }
 
-type GrafanaTimeSeriesQueryResponse []GrafanaTimeSeriesQueryResponseElement
-
 type GrafanaTimeSeriesQueryResponseElement struct {
-	Datapoints [][]interface{} `json:"datapoints"`
-	Target     string          `json:"target"`
+	Datapoints [][]interface{}      `json:"datapoints"`
+	Target     string               `json:"target"`
+	RefID      string               `json:"refId,omitempty"`
+	Meta       *GrafanaResponseMeta `json:"meta,omitempty"`
+}
+
+// the data frame response of the json datasource
+type GrafanaDataFrame struct {
+	Name   string                  `json:"name"`
+	Fields []GrafanaDataFrameField `json:"fields"`
+	RefID  string                  `json:"refId,omitempty"`
+	Meta   *GrafanaResponseMeta    `json:"meta,omitempty"`
+}
+
+// the meta of a response element, the refresh status of stale results with a notice grafana shows on the panel
+type GrafanaResponseMeta struct {
+	RefreshStatus
+	Notices []GrafanaNotice `json:"notices,omitempty"`
+}
+
+type GrafanaNotice struct {
+	Severity string `json:"severity"` // info, warning or error
+	Text     string `json:"text"`
 }
 
-//**************** RULE STUFF ************************
+type GrafanaDataFrameField struct {
+	Name   string        `json:"name"`
+	Type   string        `json:"type"` // number, time or string
+	Values []interface{} `json:"values"`
+}
+
+// **************** RULE STUFF ************************
 type DataSelectorRuleActions interface {
 	// returns a datablock and a bool if the rule applied or not
 	ApplyRuleToDataBlock(dataSourceDataBlock Datablock) (Datablock, bool)
 	GetRuleType() string
+	// returns the problems with the rule's settings, the Field of a problem is the rule's json field
+	// columnList is the columns the rule is applied to
+	ValidateRule(columnList []string) []ConfigProblem
+}
+
+// implemented by rules that depend on the request (e.g. its interval) rather than only on the datablock,
+// the rule is given the query parameters of the request before it is applied
+type queryParametersRule interface {
+	withQueryParameters(params QueryParameters) DataSelectorRuleActions
 }
 
 type DataSelectorRuleSet []DataSelectorRuleActions
@@ -745,6 +861,11 @@ func (rule GrafanaTimeSeriesRule) GetRuleType() string {
 	return rule.RuleType
 }
 
+func (rule GrafanaTimeSeriesRule) ValidateRule(columnList []string) []ConfigProblem {
+	problems := checkColumnHeader("time_column_header", rule.TimeColumnHeader, columnList)
+	return append(problems, checkColumnHeader("metric_column_header", rule.MetricColumnHeader, columnList)...)
+}
+
 func (rule GrafanaTimeSeriesRule) ApplyRuleToDataBlock(dataSourceDataBlock Datablock) (Datablock, bool) {
 	var timeColumnIndex int = -1
 	var metricColumnIndex int = -1
@@ -775,6 +896,7 @@ func (rule GrafanaTimeSeriesRule) ApplyRuleToDataBlock(dataSourceDataBlock Datab
 		return Datablock{
 			Title:       dataSourceDataBlock.Title,
 			ColumnList:  []string{rule.TimeColumnHeader, rule.MetricColumnHeader},
+			ColumnTypes: dataSourceDataBlock.columnTypesFor(timeColumnIndex, metricColumnIndex),
 			RowList:     dataSourceDataBlock.RowList,
 			Rowdata:     rowData,
 			UpdatedTime: dataSourceDataBlock.UpdatedTime,
@@ -794,6 +916,14 @@ func (rule FilterRowMatchRegexRule) GetRuleType() string {
 	return rule.RuleType
 }
 
+func (rule FilterRowMatchRegexRule) ValidateRule(columnList []string) []ConfigProblem {
+	problems := checkColumnHeader("column_header_to_check", rule.ColumnHeaderToCheck, columnList)
+	if _, err := regexp.Compile(rule.RegexString); err != nil {
+		problems = append(problems, ConfigProblem{Field: "regex_string", Message: "Invalid regex " + err.Error()})
+	}
+	return problems
+}
+
 func (rule FilterRowMatchRegexRule) ApplyRuleToDataBlock(dataSourceDataBlock Datablock) (Datablock, bool) {
 	var filterColumnIndex int = -1
 
@@ -810,9 +940,13 @@ func (rule FilterRowMatchRegexRule) ApplyRuleToDataBlock(dataSourceDataBlock Dat
 		dblockRows := dataSourceDataBlock.Rowdata
 
 		for _, k := range sortedKeysForDataBlockData(dblockRows) {
-			filterColumnData := dblockRows[k][filterColumnIndex].(string)
+			// numbers and times are matched as their text, an empty (nil) value never matches
+			filterColumnValue := rowValue(dblockRows[k], filterColumnIndex)
+			if filterColumnValue == nil {
+				continue
+			}
 
-			matched, err := regexp.MatchString(rule.RegexString, filterColumnData)
+			matched, err := regexp.MatchString(rule.RegexString, variableValueString(filterColumnValue))
 
 			if matched && err == nil {
 				rowData[k] = dblockRows[k]
@@ -822,6 +956,7 @@ func (rule FilterRowMatchRegexRule) ApplyRuleToDataBlock(dataSourceDataBlock Dat
 		return Datablock{
 			Title:       dataSourceDataBlock.Title,
 			ColumnList:  dataSourceDataBlock.ColumnList,
+			ColumnTypes: dataSourceDataBlock.ColumnTypes,
 			RowList:     dataSourceDataBlock.RowList,
 			Rowdata:     rowData,
 			UpdatedTime: dataSourceDataBlock.UpdatedTime,
@@ -846,7 +981,7 @@ func (rules *DataSelectorRules) UnmarshalJSON(b []byte) error {
 		err := json.Unmarshal(rawRules[i], &ruleType)
 
 		if err != nil {
-			return err
+			return newRuleError(i, err)
 		}
 
 		if ruleType.RuleType == "timerule" {
@@ -854,7 +989,39 @@ func (rules *DataSelectorRules) UnmarshalJSON(b []byte) error {
 
 			err := json.Unmarshal(rawRules[i], &rule)
 			if err != nil {
-				return err
+				return newRuleError(i, err)
+			}
+			rules.Rules = append(rules.Rules, rule)
+		} else if ruleType.RuleType == "seriesrule" {
+			rule := GrafanaMultiSeriesRule{}
+
+			err := json.Unmarshal(rawRules[i], &rule)
+			if err != nil {
+				return newRuleError(i, err)
+			}
+			rules.Rules = append(rules.Rules, rule)
+		} else if ruleType.RuleType == "aggregationrule" {
+			rule := AggregationRule{}
+
+			err := json.Unmarshal(rawRules[i], &rule)
+			if err != nil {
+				return newRuleError(i, err)
+			}
+			rules.Rules = append(rules.Rules, rule)
+		} else if ruleType.RuleType == "downsamplerule" {
+			rule := DownsampleRule{}
+
+			err := json.Unmarshal(rawRules[i], &rule)
+			if err != nil {
+				return newRuleError(i, err)
+			}
+			rules.Rules = append(rules.Rules, rule)
+		} else if ruleType.RuleType == "filterrule" {
+			rule := FilterRowCompareRule{}
+
+			err := json.Unmarshal(rawRules[i], &rule)
+			if err != nil {
+				return newRuleError(i, err)
 			}
 			rules.Rules = append(rules.Rules, rule)
 		} else if ruleType.RuleType == "regexrule" {
@@ -862,11 +1029,11 @@ func (rules *DataSelectorRules) UnmarshalJSON(b []byte) error {
 
 			err := json.Unmarshal(rawRules[i], &rule)
 			if err != nil {
-				return err
+				return newRuleError(i, err)
 			}
 			rules.Rules = append(rules.Rules, rule)
 		} else {
-			return errors.New("Unknown Ruletype")
+			return &RuleError{Index: i, Field: "rule_type", Message: "Unknown Ruletype " + ruleType.RuleType}
 		}
 	}
 	return nil
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConvertDataBlockToGrafanaTimeSeries(t *testing.T) {
+	at := time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC)
+	atMS := at.UnixNano() / int64(time.Millisecond)
+
+	tests := []struct {
+		name       string
+		rows       map[int][]interface{}
+		datapoints int
+		wantErr    bool
+	}{
+		{"times", map[int][]interface{}{1: {at, 1.5}, 2: {at.Add(time.Minute), 2.5}}, 2, false},
+		{"epoch ms", map[int][]interface{}{1: {atMS, 1.5}, 2: {float64(atMS), 2.5}}, 2, false},
+		{"rfc3339 strings", map[int][]interface{}{1: {"2026-10-17T01:00:00Z", 1.5}}, 1, false},
+		{"empty times are skipped", map[int][]interface{}{1: {nil, 1.5}, 2: {at, 2.5}}, 1, false},
+		{"unparsable times are skipped", map[int][]interface{}{1: {"yesterday", 1.5}, 2: {at, 2.5}}, 1, false},
+		{"only empty times", map[int][]interface{}{1: {nil, 1.5}}, 0, false},
+		{"not a time column", map[int][]interface{}{1: {"host a", 1.5}, 2: {"host b", 2.5}}, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			datablock := Datablock{ColumnList: []string{"time", "cpu"}, Rowdata: test.rows}
+			elements, err := convertDataBlockToGrafanaTimeSeries(datablock)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if len(elements) != 1 || len(elements[0].Datapoints) != test.datapoints {
+				t.Fatalf("got %v, want %d datapoints", elements, test.datapoints)
+			}
+			if test.datapoints > 0 && elements[0].Datapoints[0][1] != atMS {
+				t.Fatalf("first datapoint time %v, want %d", elements[0].Datapoints[0][1], atMS)
+			}
+		})
+	}
+}
+
+func TestOnlySeriesRuleDatablocksHaveASeriesPerColumn(t *testing.T) {
+	at := time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC)
+	datablock := Datablock{
+		ColumnList: []string{"time", "cpu", "host"},
+		Rowdata:    map[int][]interface{}{1: {at, nil, "web1"}, 2: {at.Add(time.Minute), 2.5, "web2"}},
+	}
+
+	elements, err := convertDataBlockToGrafanaTimeSeries(datablock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 1 || elements[0].Target != "cpu" || len(elements[0].Datapoints) != 2 {
+		t.Fatalf("got %v, want the cpu column as the only series with every row", elements)
+	}
+
+	datablock.ColumnList = []string{"time", "web1", "web2"}
+	datablock.Rowdata = map[int][]interface{}{1: {at, 1.5, nil}, 2: {at.Add(time.Minute), nil, 2.5}}
+	datablock.multiSeries = true
+	elements, err = convertDataBlockToGrafanaTimeSeries(datablock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 2 || elements[0].Target != "web1" || elements[1].Target != "web2" ||
+		len(elements[0].Datapoints) != 1 || len(elements[1].Datapoints) != 1 {
+		t.Fatalf("got %v, want a series per column without the rows missing it", elements)
+	}
+}
+
+func TestStaleResultsAreMarkedInTheMeta(t *testing.T) {
+	lastSuccess := time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC)
+	datablock := Datablock{
+		ColumnList: []string{"time", "v"},
+		Rowdata:    map[int][]interface{}{1: {lastSuccess, int64(1)}},
+	}
+
+	table := convertDataBlockToGrafanaTable(datablock)
+	table.Meta = staleResponseMeta(datablock.RefreshStatus)
+	if responseJSON, _ := json.Marshal(table); strings.Contains(string(responseJSON), `"meta"`) {
+		t.Fatalf("fresh results have a meta: %s", responseJSON)
+	}
+
+	datablock.RefreshStatus = RefreshStatus{Stale: true, LastError: "connection refused", LastSuccessTime: lastSuccess}
+	meta := staleResponseMeta(datablock.RefreshStatus)
+	if meta == nil || !meta.Stale || meta.LastError != "connection refused" || !meta.LastSuccessTime.Equal(lastSuccess) {
+		t.Fatalf("stale results have meta %+v", meta)
+	}
+	if len(meta.Notices) != 1 || meta.Notices[0].Severity != "warning" ||
+		!strings.Contains(meta.Notices[0].Text, "2026-10-17T01:00:00Z") || !strings.Contains(meta.Notices[0].Text, "connection refused") {
+		t.Fatalf("stale results have notices %+v", meta.Notices)
+	}
+
+	frame := convertDataBlockToGrafanaDataFrame(datablock)
+	frame.Meta = meta
+	responseJSON, _ := json.Marshal(frame)
+	var decoded struct {
+		Meta struct {
+			Stale   bool              `json:"stale"`
+			Notices []json.RawMessage `json:"notices"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(responseJSON, &decoded); err != nil || !decoded.Meta.Stale || len(decoded.Meta.Notices) != 1 {
+		t.Fatalf("stale frame json %s", responseJSON)
+	}
+}
+
+func TestGetAnnotationEvents(t *testing.T) {
+	cfgRoot := newTestCfg(t)
+	writeTestCfg(t, cfgRoot, map[string]string{
+		"query/events.json": `{"name": "events", "database_name": "demo", "refresh_time": 60,
+			"column_list": ["time", "time_end", "title", "text", "tags"], "query_string": "` +
+			`select '2026-10-17T01:00:00Z' as time, null as time_end, 'a' as title, 'point at the start' as text, 'deploy, web' as tags` +
+			` union all select '2026-10-17T00:00:00Z', '2026-10-17T01:30:00Z', 'b', 'region into the range', null` +
+			` union all select '2026-10-17T00:00:00Z', '2026-10-17T00:30:00Z', 'c', 'region before the range', null` +
+			` union all select '2026-10-17T04:00:00Z', null, 'd', 'point after the range', 'deploy'` +
+			` union all select '2026-10-17T02:00:00Z', '2026-10-17T02:00:00Z', 'e', 'end not after the time', ' web ,,'` +
+			` union all select '2026-10-17T00:30:00Z', null, 'f', 'point before the range', null"}`,
+		"annotation/deploys.json": `{"name": "deploys", "query_name": "events", "time_column_header": "time",
+			"time_end_column_header": "time_end", "title_column_header": "title", "text_column_header": "text",
+			"tags_column_header": "tags", "tags": ["ops"]}`,
+	})
+	defer loadTestCfg(t, cfgRoot)()
+
+	at := func(hour, minute int) time.Time { return time.Date(2026, 10, 17, hour, minute, 0, 0, time.UTC) }
+	params := defaultQueryParameters()
+	params.TimeRange = TimeRange{From: at(1, 0), To: at(3, 0)}
+
+	events, httpCode, errorString := getAnnotationEvents(context.Background(), "deploys", params)
+	if errorString != "" {
+		t.Fatalf("%d %s", httpCode, errorString)
+	}
+	want := []AnnotationEvent{
+		{Time: at(1, 0), Title: "a", Text: "point at the start", Tags: []string{"deploy", "web", "ops"}},
+		{Time: at(0, 0), TimeEnd: at(1, 30), Title: "b", Text: "region into the range", Tags: []string{"ops"}},
+		{Time: at(2, 0), Title: "e", Text: "end not after the time", Tags: []string{"web", "ops"}},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %+v, want %+v", events, want)
+	}
+	for i := range want {
+		if !events[i].Time.Equal(want[i].Time) || !events[i].TimeEnd.Equal(want[i].TimeEnd) || events[i].Title != want[i].Title ||
+			events[i].Text != want[i].Text || !reflect.DeepEqual(events[i].Tags, want[i].Tags) {
+			t.Errorf("event %d is %+v, want %+v", i, events[i], want[i])
+		}
+	}
+
+	// a cfg with problems is still served, so the columns can be missing from the query's results
+	writeTestCfg(t, cfgRoot, map[string]string{
+		"annotation/no-text.json": `{"name": "no-text", "query_name": "events", "time_column_header": "time", "text_column_header": "body"}`,
+		"annotation/no-time.json": `{"name": "no-time", "query_name": "events", "time_column_header": "when"}`,
+	})
+	if problems, err := reloadConfig(cfgRoot, false); err != nil || len(problems) != 2 {
+		t.Fatalf("reload got problems %v, %v, want the two missing columns", problems, err)
+	}
+	for name, wantError := range map[string]string{
+		"no-text": "Could not find annotation text_column_header body in query events",
+		"no-time": "Could not find annotation time column in query events",
+	} {
+		if _, httpCode, errorString := getAnnotationEvents(context.Background(), name, params); httpCode != http.StatusInternalServerError || errorString != wantError {
+			t.Errorf("annotation %s got %d %q, want %q", name, httpCode, errorString, wantError)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queryRefreshDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dashboard_query_refresh_duration_seconds",
+		Help:    "How long running a query on its database took, including failed runs.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"query"})
+
+	queryRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dashboard_query_refreshes_total",
+		Help: "Query runs by result (success or error).",
+	}, []string{"query", "result"})
+
+	queryRows = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dashboard_query_rows",
+		Help: "Rows returned by the latest successful run of a query.",
+	}, []string{"query"})
+
+	queryCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dashboard_query_cache_requests_total",
+		Help: "Requests for a query's datablock by result: hit (served from the cache), stale (served from the " +
+			"cache after a failed refresh) or miss (waited for the query to run).",
+	}, []string{"query", "result"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dashboard_http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(databaseCollector{})
+}
+
+// records a run of a query, rows is only used if the run succeeded
+func observeQueryRefresh(queryName string, duration time.Duration, rows int, err error) {
+	queryRefreshDuration.WithLabelValues(queryName).Observe(duration.Seconds())
+	if err != nil {
+		queryRefreshes.WithLabelValues(queryName, "error").Inc()
+		return
+	}
+	queryRefreshes.WithLabelValues(queryName, "success").Inc()
+	queryRows.WithLabelValues(queryName).Set(float64(rows))
+}
+
+// records the latency and status code of every request by its chi route pattern, so /query/{queryName}
+// is one series rather than one per query name
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if routeContext := chi.RouteContext(r.Context()); routeContext != nil && routeContext.RoutePattern() != "" {
+			route = routeContext.RoutePattern()
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		httpRequestDuration.WithLabelValues(route, r.Method, strconv.Itoa(code)).Observe(time.Since(startTime).Seconds())
+	})
+}
+
+// databaseCollector reports the connection pool stats and health of the databases of the current config
+// when scraped, so databases added or removed by a reload show up without registering anything
+type databaseCollector struct{}
+
+var (
+	databaseUpDesc = prometheus.NewDesc("dashboard_database_up",
+		"1 if the latest health check ping of the database succeeded, 0 if it failed or hasn't run yet.",
+		[]string{"database", "db_type"}, nil)
+	databaseOpenConnectionsDesc = prometheus.NewDesc("dashboard_database_open_connections",
+		"Connections open to the database, in use or idle.", []string{"database"}, nil)
+	databaseInUseConnectionsDesc = prometheus.NewDesc("dashboard_database_in_use_connections",
+		"Connections to the database currently in use.", []string{"database"}, nil)
+	databaseIdleConnectionsDesc = prometheus.NewDesc("dashboard_database_idle_connections",
+		"Idle connections to the database.", []string{"database"}, nil)
+	databaseMaxOpenConnectionsDesc = prometheus.NewDesc("dashboard_database_max_open_connections",
+		"The database's max_open_connections, 0 is unlimited.", []string{"database"}, nil)
+	databaseWaitsDesc = prometheus.NewDesc("dashboard_database_connection_waits_total",
+		"Times a query had to wait for a connection to the database.", []string{"database"}, nil)
+	databaseWaitDurationDesc = prometheus.NewDesc("dashboard_database_connection_wait_seconds_total",
+		"Total time queries waited for a connection to the database.", []string{"database"}, nil)
+)
+
+func (databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- databaseUpDesc
+	ch <- databaseOpenConnectionsDesc
+	ch <- databaseInUseConnectionsDesc
+	ch <- databaseIdleConnectionsDesc
+	ch <- databaseMaxOpenConnectionsDesc
+	ch <- databaseWaitsDesc
+	ch <- databaseWaitDurationDesc
+}
+
+func (databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, database := range currentConfig().dbMap {
+		status := database.healthStatus()
+		up := 0.0
+		if status.Status == "up" {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(databaseUpDesc, prometheus.GaugeValue, up, database.Name, database.DBType)
+
+		stats := database.DB.Stats()
+		ch <- prometheus.MustNewConstMetric(databaseOpenConnectionsDesc, prometheus.GaugeValue, float64(stats.OpenConnections), database.Name)
+		ch <- prometheus.MustNewConstMetric(databaseInUseConnectionsDesc, prometheus.GaugeValue, float64(stats.InUse), database.Name)
+		ch <- prometheus.MustNewConstMetric(databaseIdleConnectionsDesc, prometheus.GaugeValue, float64(stats.Idle), database.Name)
+		ch <- prometheus.MustNewConstMetric(databaseMaxOpenConnectionsDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections), database.Name)
+		ch <- prometheus.MustNewConstMetric(databaseWaitsDesc, prometheus.CounterValue, float64(stats.WaitCount), database.Name)
+		ch <- prometheus.MustNewConstMetric(databaseWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds(), database.Name)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestRejectedRequestsAreLabelledWithTheirRoute(t *testing.T) {
+	cfgRoot := newTestCfg(t)
+	writeTestCfg(t, cfgRoot, map[string]string{
+		"client/team-a.json": `{"name": "team-a", "api_key": "k1"}`,
+	})
+	defer loadTestCfg(t, cfgRoot)()
+	router := registerRoutes(defaultServerConfig())
+
+	requests := []struct {
+		method string
+		path   string
+		apiKey string
+		want   string
+	}{
+		{http.MethodPost, "/query", "", `code="401",method="POST",route="/query"`},
+		{http.MethodGet, "/dataselector/dq", "wrong", `code="401",method="GET",route="/dataselector/{dataSelectorName}"`},
+		{http.MethodGet, "/status/query", "k1", `code="403",method="GET",route="/status/query"`},
+		{http.MethodGet, "/no-such-route", "", `code="404",method="GET",route="unmatched"`},
+	}
+	for _, request := range requests {
+		r := httptest.NewRequest(request.method, request.path, strings.NewReader("{}"))
+		if request.apiKey != "" {
+			r.Header.Set("X-API-Key", request.apiKey)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	recorder := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	for _, request := range requests {
+		if !strings.Contains(string(body), "dashboard_http_request_duration_seconds_count{"+request.want+"}") {
+			t.Errorf("%s %s isn't counted with %s", request.method, request.path, request.want)
+		}
+	}
+}
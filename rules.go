@@ -0,0 +1,856 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GrafanaMultiSeriesRule turns rows of time, series name and metrics (e.g. SELECT ts, host, cpu) into one
+// column per series (a line per host), for timeserie targets. The result has the time column followed by a
+// column per series and metric named "<series> <metric>", or just the series name if there is one metric
+// and just the metric if there is no series column. A series without a value at a time has nil there
+type GrafanaMultiSeriesRule struct {
+	RuleType            string   `json:"rule_type"`
+	TimeColumnHeader    string   `json:"time_column_header"`
+	MetricColumnHeaders []string `json:"metric_column_headers"`
+	SeriesColumnHeader  string   `json:"series_column_header"` // optional, a series per distinct value of the column
+}
+
+func (rule GrafanaMultiSeriesRule) GetRuleType() string {
+	return rule.RuleType
+}
+
+func (rule GrafanaMultiSeriesRule) ValidateRule(columnList []string) []ConfigProblem {
+	var problems []ConfigProblem
+	if rule.TimeColumnHeader == "" {
+		problems = append(problems, ConfigProblem{Field: "time_column_header", Message: "Missing time_column_header"})
+	}
+	if len(rule.MetricColumnHeaders) == 0 {
+		problems = append(problems, ConfigProblem{Field: "metric_column_headers", Message: "Missing metric_column_headers"})
+	}
+	problems = append(problems, checkColumnHeader("time_column_header", rule.TimeColumnHeader, columnList)...)
+	problems = append(problems, checkColumnHeader("series_column_header", rule.SeriesColumnHeader, columnList)...)
+	for i, header := range rule.MetricColumnHeaders {
+		problems = append(problems, checkColumnHeader(ruleListField("metric_column_headers", i), header, columnList)...)
+	}
+	return problems
+}
+
+func (rule GrafanaMultiSeriesRule) ApplyRuleToDataBlock(dataSourceDataBlock Datablock) (Datablock, bool) {
+	timeColumnIndex := columnIndexForHeader(dataSourceDataBlock.ColumnList, rule.TimeColumnHeader)
+	seriesColumnIndex := -1
+	if rule.SeriesColumnHeader != "" {
+		seriesColumnIndex = columnIndexForHeader(dataSourceDataBlock.ColumnList, rule.SeriesColumnHeader)
+		if seriesColumnIndex == -1 {
+			return dataSourceDataBlock, false
+		}
+	}
+	var metricColumnIndexes []int
+	for _, header := range rule.MetricColumnHeaders {
+		metricColumnIndex := columnIndexForHeader(dataSourceDataBlock.ColumnList, header)
+		if metricColumnIndex == -1 {
+			return dataSourceDataBlock, false
+		}
+		metricColumnIndexes = append(metricColumnIndexes, metricColumnIndex)
+	}
+	if timeColumnIndex == -1 || len(metricColumnIndexes) == 0 {
+		return dataSourceDataBlock, false
+	}
+
+	// the series (columns) and times (rows) in the order they first show up in the rows
+	var seriesNames []string
+	seriesColumnIndexes := []int{timeColumnIndex} // the source column of each column, for the column types
+	seriesColumns := make(map[string]int)
+	var times []interface{}
+	timeRows := make(map[string]map[int]interface{})
+
+	// without a series column the series are the metrics, so there are columns for them even without rows
+	addSeries := func(seriesName string, metricColumnIndex int) int {
+		seriesColumn, found := seriesColumns[seriesName]
+		if !found {
+			seriesColumn = len(seriesNames) + 1
+			seriesColumns[seriesName] = seriesColumn
+			seriesNames = append(seriesNames, seriesName)
+			seriesColumnIndexes = append(seriesColumnIndexes, metricColumnIndex)
+		}
+		return seriesColumn
+	}
+	if seriesColumnIndex == -1 {
+		for i, metricColumnIndex := range metricColumnIndexes {
+			addSeries(rule.MetricColumnHeaders[i], metricColumnIndex)
+		}
+	}
+
+	dblockRows := dataSourceDataBlock.Rowdata
+	for _, k := range sortedKeysForDataBlockData(dblockRows) {
+		row := dblockRows[k]
+
+		timeValue := rowValue(row, timeColumnIndex)
+		timeKey := seriesTimeKey(timeValue)
+		values, found := timeRows[timeKey]
+		if !found {
+			values = make(map[int]interface{})
+			timeRows[timeKey] = values
+			times = append(times, timeValue)
+		}
+
+		for i, metricColumnIndex := range metricColumnIndexes {
+			seriesColumn := addSeries(rule.seriesName(row, seriesColumnIndex, rule.MetricColumnHeaders[i]), metricColumnIndex)
+			values[seriesColumn] = rowValue(row, metricColumnIndex)
+		}
+	}
+
+	var rowData = make(map[int][]interface{})
+	for i, timeValue := range times {
+		values := timeRows[seriesTimeKey(timeValue)]
+		newRow := make([]interface{}, len(seriesNames)+1)
+		newRow[0] = timeValue
+		for seriesColumn, value := range values {
+			newRow[seriesColumn] = value
+		}
+		rowData[i+1] = newRow
+	}
+
+	return Datablock{
+		Title:       dataSourceDataBlock.Title,
+		ColumnList:  append([]string{rule.TimeColumnHeader}, seriesNames...),
+		ColumnTypes: dataSourceDataBlock.columnTypesFor(seriesColumnIndexes...),
+		RowList:     dataSourceDataBlock.RowList,
+		Rowdata:     rowData,
+		UpdatedTime: dataSourceDataBlock.UpdatedTime,
+		multiSeries: true,
+	}, true
+}
+
+// the series columns are named by the values of the series column
+func (rule GrafanaMultiSeriesRule) columnsDependOnData() bool {
+	return rule.SeriesColumnHeader != ""
+}
+
+// the name of the series a metric of the row belongs to
+func (rule GrafanaMultiSeriesRule) seriesName(row []interface{}, seriesColumnIndex int, metricHeader string) string {
+	if seriesColumnIndex == -1 {
+		return metricHeader
+	}
+	seriesValue := variableValueString(rowValue(row, seriesColumnIndex))
+	if len(rule.MetricColumnHeaders) == 1 {
+		return seriesValue
+	}
+	return seriesValue + " " + metricHeader
+}
+
+// the rows of a time are merged by this key, a time.Time is keyed by its instant so the same time in two
+// locations is one row
+func seriesTimeKey(value interface{}) string {
+	if timeValue, ok := value.(time.Time); ok {
+		return timeValue.UTC().Format(time.RFC3339Nano)
+	}
+	return variableValueString(value)
+}
+
+// AggregationRule groups the rows by the values of the group by columns (like sql GROUP BY) and computes
+// the aggregations over each group. The result has the group by columns followed by a column per
+// aggregation, a row per group in the order the groups first show up. Without group by columns all the
+// rows are one group, so the result is one row even if there are no rows
+type AggregationRule struct {
+	RuleType             string        `json:"rule_type"`
+	GroupByColumnHeaders []string      `json:"group_by_column_headers"`
+	Aggregations         []Aggregation `json:"aggregations"`
+}
+
+// Aggregation is a function over a column of the rows of a group. Values that are nil or not numbers are
+// left out, except by count which counts the values that are not nil (or the rows if column_header is empty)
+type Aggregation struct {
+	Function     string  `json:"function"` // sum, avg, min, max, count or percentile
+	ColumnHeader string  `json:"column_header"`
+	Percentile   float64 `json:"percentile"` // 0 to 100 for the percentile function, e.g. 95
+	As           string  `json:"as"`         // the header of the result column, defaults to e.g. avg(cpu) or p95(cpu)
+}
+
+var aggregationFunctions = []string{"sum", "avg", "min", "max", "count", "percentile"}
+
+func (rule AggregationRule) GetRuleType() string {
+	return rule.RuleType
+}
+
+func (rule AggregationRule) ValidateRule(columnList []string) []ConfigProblem {
+	var problems []ConfigProblem
+	if len(rule.Aggregations) == 0 {
+		problems = append(problems, ConfigProblem{Field: "aggregations", Message: "Missing aggregations"})
+	}
+	for i, header := range rule.GroupByColumnHeaders {
+		problems = append(problems, checkColumnHeader(ruleListField("group_by_column_headers", i), header, columnList)...)
+	}
+	for i, aggregation := range rule.Aggregations {
+		field := ruleListField("aggregations", i)
+		if !containsString(aggregationFunctions, aggregation.Function) {
+			problems = append(problems, ConfigProblem{Field: field + ".function",
+				Message: "Unknown function " + aggregation.Function + ", use sum, avg, min, max, count or percentile"})
+		}
+		if aggregation.Function == "percentile" && (aggregation.Percentile < 0 || aggregation.Percentile > 100) {
+			problems = append(problems, ConfigProblem{Field: field + ".percentile", Message: "percentile must be from 0 to 100"})
+		}
+		if aggregation.ColumnHeader == "" && aggregation.Function != "count" {
+			problems = append(problems, ConfigProblem{Field: field + ".column_header", Message: "Missing column_header"})
+		}
+		problems = append(problems, checkColumnHeader(field+".column_header", aggregation.ColumnHeader, columnList)...)
+	}
+	return problems
+}
+
+func (rule AggregationRule) ApplyRuleToDataBlock(dataSourceDataBlock Datablock) (Datablock, bool) {
+	var groupByColumnIndexes []int
+	for _, header := range rule.GroupByColumnHeaders {
+		columnIndex := columnIndexForHeader(dataSourceDataBlock.ColumnList, header)
+		if columnIndex == -1 {
+			return dataSourceDataBlock, false
+		}
+		groupByColumnIndexes = append(groupByColumnIndexes, columnIndex)
+	}
+	// -1 for a count of the rows
+	aggregationColumnIndexes := make([]int, len(rule.Aggregations))
+	for i, aggregation := range rule.Aggregations {
+		aggregationColumnIndexes[i] = -1
+		if aggregation.ColumnHeader == "" {
+			continue
+		}
+		aggregationColumnIndexes[i] = columnIndexForHeader(dataSourceDataBlock.ColumnList, aggregation.ColumnHeader)
+		if aggregationColumnIndexes[i] == -1 {
+			return dataSourceDataBlock, false
+		}
+	}
+
+	// the rows of each group, the groups in the order they first show up in the rows
+	var groupKeys []string
+	groupRows := make(map[string][][]interface{})
+	if len(groupByColumnIndexes) == 0 {
+		groupKeys = append(groupKeys, "")
+		groupRows[""] = nil
+	}
+
+	dblockRows := dataSourceDataBlock.Rowdata
+	for _, k := range sortedKeysForDataBlockData(dblockRows) {
+		row := dblockRows[k]
+		keyParts := make([]string, len(groupByColumnIndexes))
+		for i, columnIndex := range groupByColumnIndexes {
+			keyParts[i] = seriesTimeKey(rowValue(row, columnIndex))
+		}
+		groupKey := strings.Join(keyParts, "\x00")
+		if _, found := groupRows[groupKey]; !found {
+			groupKeys = append(groupKeys, groupKey)
+		}
+		groupRows[groupKey] = append(groupRows[groupKey], row)
+	}
+
+	var rowData = make(map[int][]interface{})
+	for i, groupKey := range groupKeys {
+		rows := groupRows[groupKey]
+		newRow := make([]interface{}, 0, len(groupByColumnIndexes)+len(rule.Aggregations))
+		for _, columnIndex := range groupByColumnIndexes {
+			newRow = append(newRow, rowValue(rows[0], columnIndex))
+		}
+		for j, aggregation := range rule.Aggregations {
+			newRow = append(newRow, aggregation.apply(rows, aggregationColumnIndexes[j]))
+		}
+		rowData[i+1] = newRow
+	}
+
+	columnList := append([]string{}, rule.GroupByColumnHeaders...)
+	for _, aggregation := range rule.Aggregations {
+		columnList = append(columnList, aggregation.header())
+	}
+	var columnTypes []string
+	if groupByColumnTypes := dataSourceDataBlock.columnTypesFor(groupByColumnIndexes...); groupByColumnTypes != nil {
+		columnTypes = groupByColumnTypes
+		for range rule.Aggregations {
+			columnTypes = append(columnTypes, columnTypeNumber)
+		}
+	}
+
+	return Datablock{
+		Title:       dataSourceDataBlock.Title,
+		ColumnList:  columnList,
+		ColumnTypes: columnTypes,
+		RowList:     dataSourceDataBlock.RowList,
+		Rowdata:     rowData,
+		UpdatedTime: dataSourceDataBlock.UpdatedTime,
+	}, true
+}
+
+// the header of the aggregation's result column, a count of the rows is just count
+func (aggregation Aggregation) header() string {
+	if aggregation.As != "" {
+		return aggregation.As
+	}
+	if aggregation.Function == "percentile" {
+		return "p" + strconv.FormatFloat(aggregation.Percentile, 'f', -1, 64) + "(" + aggregation.ColumnHeader + ")"
+	}
+	if aggregation.ColumnHeader == "" {
+		return aggregation.Function
+	}
+	return aggregation.Function + "(" + aggregation.ColumnHeader + ")"
+}
+
+// the aggregation over the column of the rows, nil if there are no numbers to aggregate
+func (aggregation Aggregation) apply(rows [][]interface{}, columnIndex int) interface{} {
+	if aggregation.Function == "count" {
+		count := int64(0)
+		for _, row := range rows {
+			if columnIndex == -1 || rowValue(row, columnIndex) != nil {
+				count++
+			}
+		}
+		return count
+	}
+
+	var values []float64
+	for _, row := range rows {
+		if value, ok := numericValue(rowValue(row, columnIndex)); ok {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	switch aggregation.Function {
+	case "sum", "avg":
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		if aggregation.Function == "avg" {
+			return sum / float64(len(values))
+		}
+		return sum
+	case "min", "max":
+		result := values[0]
+		for _, value := range values[1:] {
+			if (aggregation.Function == "min" && value < result) || (aggregation.Function == "max" && value > result) {
+				result = value
+			}
+		}
+		return result
+	case "percentile":
+		return percentile(values, aggregation.Percentile)
+	}
+	return nil
+}
+
+// the percentile (0 to 100) of the values, interpolated between the closest ranks. A percentile out of
+// range is clamped to the min or max so a rule that skipped validation can't index out of the values
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	rank := p / 100 * float64(len(sorted)-1)
+	if !(rank > 0) { // NaN too
+		rank = 0
+	} else if rank > float64(len(sorted)-1) {
+		rank = float64(len(sorted) - 1)
+	}
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// the value as a float64 if it is a number
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// DownsampleRule reduces the rows of a time ordered datablock to about the points grafana can show, using
+// the interval and max data points of the /query request. With the avg, min, max and last methods the rows
+// are bucketed by time (the request's interval, widened so there are at most max data points buckets) and
+// each bucket is a row at the bucket's start time. Number columns are aggregated and other columns have
+// the bucket's last value. The lttb method (largest triangle three buckets) keeps the max data points rows
+// that best keep the shape of the value column. Requests without an interval or max data points (e.g.
+// /dataselectordata) get every row
+type DownsampleRule struct {
+	RuleType          string `json:"rule_type"`
+	TimeColumnHeader  string `json:"time_column_header"`
+	Method            string `json:"method"`              // avg, min, max, last or lttb, defaults to avg
+	ValueColumnHeader string `json:"value_column_header"` // lttb only, defaults to the first column after the time column
+	intervalMS        int64
+	maxDataPoints     int64
+}
+
+var downsampleMethods = []string{"avg", "min", "max", "last", "lttb"}
+
+func (rule DownsampleRule) GetRuleType() string {
+	return rule.RuleType
+}
+
+func (rule DownsampleRule) ValidateRule(columnList []string) []ConfigProblem {
+	var problems []ConfigProblem
+	if rule.TimeColumnHeader == "" {
+		problems = append(problems, ConfigProblem{Field: "time_column_header", Message: "Missing time_column_header"})
+	}
+	if rule.Method != "" && !containsString(downsampleMethods, rule.Method) {
+		problems = append(problems, ConfigProblem{Field: "method", Message: "Unknown method " + rule.Method + ", use avg, min, max, last or lttb"})
+	}
+	problems = append(problems, checkColumnHeader("time_column_header", rule.TimeColumnHeader, columnList)...)
+	problems = append(problems, checkColumnHeader("value_column_header", rule.ValueColumnHeader, columnList)...)
+	return problems
+}
+
+func (rule DownsampleRule) withQueryParameters(params QueryParameters) DataSelectorRuleActions {
+	rule.intervalMS = params.TimeRange.IntervalMS
+	rule.maxDataPoints = params.MaxDataPoints
+	return rule
+}
+
+func (rule DownsampleRule) ApplyRuleToDataBlock(dataSourceDataBlock Datablock) (Datablock, bool) {
+	timeColumnIndex := columnIndexForHeader(dataSourceDataBlock.ColumnList, rule.TimeColumnHeader)
+	if timeColumnIndex == -1 {
+		return dataSourceDataBlock, false
+	}
+
+	dblockRows := dataSourceDataBlock.Rowdata
+	var rows [][]interface{}
+	var times []int64 // epoch ns of each row
+	for _, k := range sortedKeysForDataBlockData(dblockRows) {
+		rowTime, ok := rowValue(dblockRows[k], timeColumnIndex).(time.Time)
+		if !ok {
+			return dataSourceDataBlock, false
+		}
+		rows = append(rows, dblockRows[k])
+		times = append(times, rowTime.UnixNano())
+	}
+
+	var downsampledRows [][]interface{}
+	if rule.Method == "lttb" {
+		valueColumnIndex := timeColumnIndex + 1
+		if rule.ValueColumnHeader != "" {
+			valueColumnIndex = columnIndexForHeader(dataSourceDataBlock.ColumnList, rule.ValueColumnHeader)
+		}
+		if valueColumnIndex == -1 || valueColumnIndex >= len(dataSourceDataBlock.ColumnList) {
+			return dataSourceDataBlock, false
+		}
+		threshold := int(rule.maxDataPoints)
+		if threshold == 0 && rule.intervalMS > 0 && len(times) > 0 {
+			threshold = int((times[len(times)-1]-times[0])/(rule.intervalMS*int64(time.Millisecond))) + 1
+		}
+		downsampledRows = lttbRows(rows, times, valueColumnIndex, threshold)
+	} else {
+		downsampledRows = rule.bucketRows(rows, times, timeColumnIndex)
+	}
+	if downsampledRows == nil {
+		return dataSourceDataBlock, true
+	}
+
+	var rowData = make(map[int][]interface{})
+	for i, row := range downsampledRows {
+		rowData[i+1] = row
+	}
+	return Datablock{
+		Title:       dataSourceDataBlock.Title,
+		ColumnList:  dataSourceDataBlock.ColumnList,
+		ColumnTypes: dataSourceDataBlock.ColumnTypes,
+		RowList:     dataSourceDataBlock.RowList,
+		Rowdata:     rowData,
+		UpdatedTime: dataSourceDataBlock.UpdatedTime,
+	}, true
+}
+
+// the bucket width in ns, the interval widened (to a multiple of the interval, or of a ms without one) so
+// the rows' time span is at most max data points buckets. 0 if the rows are not to be bucketed
+func (rule DownsampleRule) bucketWidth(times []int64) int64 {
+	width := rule.intervalMS * int64(time.Millisecond)
+	if rule.maxDataPoints > 1 && len(times) > int(rule.maxDataPoints) {
+		unit := width
+		if unit <= 0 {
+			unit = int64(time.Millisecond)
+		}
+		// a span of n widths can touch n+1 buckets
+		span := times[len(times)-1] - times[0]
+		minWidth := (span/(rule.maxDataPoints-1)/unit + 1) * unit
+		if minWidth > width {
+			width = minWidth
+		}
+	}
+	return width
+}
+
+// the rows bucketed by time in time order, nil if the rows are not to be bucketed
+func (rule DownsampleRule) bucketRows(rows [][]interface{}, times []int64, timeColumnIndex int) [][]interface{} {
+	width := rule.bucketWidth(times)
+	if width <= 0 {
+		return nil
+	}
+
+	var bucketStarts []int64
+	bucketRows := make(map[int64][][]interface{})
+	for i, row := range rows {
+		start := times[i] - times[i]%width
+		if times[i] < 0 && times[i]%width != 0 {
+			start -= width
+		}
+		if _, found := bucketRows[start]; !found {
+			bucketStarts = append(bucketStarts, start)
+		}
+		bucketRows[start] = append(bucketRows[start], row)
+	}
+	sort.Slice(bucketStarts, func(i, j int) bool { return bucketStarts[i] < bucketStarts[j] })
+
+	method := rule.Method
+	if method == "" {
+		method = "avg"
+	}
+	var downsampledRows [][]interface{}
+	for _, start := range bucketStarts {
+		rows := bucketRows[start]
+		newRow := make([]interface{}, len(rows[0]))
+		for columnIndex := range newRow {
+			if columnIndex == timeColumnIndex {
+				newRow[columnIndex] = time.Unix(0, start).In(rows[0][timeColumnIndex].(time.Time).Location())
+				continue
+			}
+			if method != "last" {
+				newRow[columnIndex] = Aggregation{Function: method}.apply(rows, columnIndex)
+			}
+			if newRow[columnIndex] == nil {
+				newRow[columnIndex] = lastValue(rows, columnIndex)
+			}
+		}
+		downsampledRows = append(downsampledRows, newRow)
+	}
+	return downsampledRows
+}
+
+// the last value of the column in the rows that is not nil
+func lastValue(rows [][]interface{}, columnIndex int) interface{} {
+	for i := len(rows) - 1; i >= 0; i-- {
+		if value := rowValue(rows[i], columnIndex); value != nil {
+			return value
+		}
+	}
+	return nil
+}
+
+// the threshold rows picked by largest triangle three buckets from the rows with a number in the value
+// column, nil if there are no more than threshold rows (or threshold is 0, no limit)
+func lttbRows(rows [][]interface{}, times []int64, valueColumnIndex int, threshold int) [][]interface{} {
+	points := [][]interface{}{} // not nil, rows without a number are dropped even if none are left
+	var xs, ys []float64
+	for i, row := range rows {
+		if value, ok := numericValue(rowValue(row, valueColumnIndex)); ok {
+			points = append(points, row)
+			xs = append(xs, float64(times[i]))
+			ys = append(ys, value)
+		}
+	}
+	if threshold <= 0 || len(rows) <= threshold {
+		return nil
+	}
+	if len(points) <= threshold {
+		return points
+	}
+	if threshold < 3 {
+		return [][]interface{}{points[0], points[len(points)-1]}[:threshold]
+	}
+
+	// the first and last points are kept, the points between are split into threshold-2 buckets and the
+	// point of each bucket forming the largest triangle with the previous pick and the next bucket's average
+	sampled := [][]interface{}{points[0]}
+	bucketSize := float64(len(points)-2) / float64(threshold-2)
+	picked := 0
+	for bucket := 0; bucket < threshold-2; bucket++ {
+		start := int(float64(bucket)*bucketSize) + 1
+		end := int(float64(bucket+1)*bucketSize) + 1
+
+		nextStart, nextEnd := end, int(float64(bucket+2)*bucketSize)+1
+		if nextEnd > len(points) {
+			nextEnd = len(points)
+		}
+		avgX, avgY := 0.0, 0.0
+		for i := nextStart; i < nextEnd; i++ {
+			avgX += xs[i]
+			avgY += ys[i]
+		}
+		if count := float64(nextEnd - nextStart); count > 0 {
+			avgX /= count
+			avgY /= count
+		}
+
+		maxArea := -1.0
+		next := start
+		for i := start; i < end; i++ {
+			area := math.Abs((xs[picked]-avgX)*(ys[i]-ys[picked]) - (xs[picked]-xs[i])*(avgY-ys[picked]))
+			if area > maxArea {
+				maxArea = area
+				next = i
+			}
+		}
+		sampled = append(sampled, points[next])
+		picked = next
+	}
+	return append(sampled, points[len(points)-1])
+}
+
+// FilterRowCompareRule keeps the rows matching its condition, e.g. status != 'OK' and duration > 30 is
+// {"rule_type": "filterrule", "and": [{"column_header": "status", "operator": "!=", "value": "OK"},
+// {"column_header": "duration", "operator": ">", "value": 30}]}
+type FilterRowCompareRule struct {
+	RuleType string `json:"rule_type"`
+	FilterCondition
+}
+
+// FilterCondition is either a comparison of a column to a value or one of the and, or and not combinators
+// Times are compared as times (the value is RFC3339 or epoch ms), numbers as numbers if the value is a
+// number (or a string of one) and everything else as text. Like sql an empty (nil) value only matches is null
+type FilterCondition struct {
+	ColumnHeader string            `json:"column_header"`
+	Operator     string            `json:"operator"` // =, !=, <, <=, >, >=, between, in or is null
+	Value        interface{}       `json:"value"`
+	Values       []interface{}     `json:"values"` // the list for in, the low and high (inclusive) for between
+	And          []FilterCondition `json:"and"`
+	Or           []FilterCondition `json:"or"`
+	Not          *FilterCondition  `json:"not"`
+}
+
+var filterOperators = []string{"=", "!=", "<", "<=", ">", ">=", "between", "in", "is null"}
+
+func (rule FilterRowCompareRule) GetRuleType() string {
+	return rule.RuleType
+}
+
+func (rule FilterRowCompareRule) ValidateRule(columnList []string) []ConfigProblem {
+	return rule.FilterCondition.validate("", columnList)
+}
+
+// the problems of the condition and the conditions it combines, prefix is the json path of the condition
+func (condition FilterCondition) validate(prefix string, columnList []string) []ConfigProblem {
+	combinators := 0
+	if condition.And != nil {
+		combinators++
+	}
+	if condition.Or != nil {
+		combinators++
+	}
+	if condition.Not != nil {
+		combinators++
+	}
+	isComparison := condition.ColumnHeader != "" || condition.Operator != ""
+	if combinators > 1 || (combinators == 1 && isComparison) {
+		return []ConfigProblem{{Field: strings.TrimSuffix(prefix, "."),
+			Message: "A condition is either a comparison or one of and, or, not"}}
+	}
+
+	var problems []ConfigProblem
+	switch {
+	case condition.And != nil || condition.Or != nil:
+		field, conditions := "and", condition.And
+		if condition.Or != nil {
+			field, conditions = "or", condition.Or
+		}
+		if len(conditions) == 0 {
+			problems = append(problems, ConfigProblem{Field: prefix + field, Message: "Missing " + field + " conditions"})
+		}
+		for i, combined := range conditions {
+			problems = append(problems, combined.validate(prefix+ruleListField(field, i)+".", columnList)...)
+		}
+	case condition.Not != nil:
+		problems = append(problems, condition.Not.validate(prefix+"not.", columnList)...)
+	default:
+		if condition.ColumnHeader == "" {
+			problems = append(problems, ConfigProblem{Field: prefix + "column_header", Message: "Missing column_header"})
+		}
+		problems = append(problems, checkColumnHeader(prefix+"column_header", condition.ColumnHeader, columnList)...)
+		switch {
+		case !containsString(filterOperators, condition.Operator):
+			problems = append(problems, ConfigProblem{Field: prefix + "operator",
+				Message: "Unknown operator " + condition.Operator + ", use =, !=, <, <=, >, >=, between, in or is null"})
+		case condition.Operator == "between" && len(condition.Values) != 2:
+			problems = append(problems, ConfigProblem{Field: prefix + "values", Message: "between needs values of a low and a high value"})
+		case condition.Operator == "in" && len(condition.Values) == 0:
+			problems = append(problems, ConfigProblem{Field: prefix + "values", Message: "in needs values to match"})
+		case condition.Operator != "between" && condition.Operator != "in" && condition.Operator != "is null" && condition.Value == nil:
+			problems = append(problems, ConfigProblem{Field: prefix + "value", Message: "Missing value, use is null to match empty values"})
+		}
+	}
+	return problems
+}
+
+func (rule FilterRowCompareRule) ApplyRuleToDataBlock(dataSourceDataBlock Datablock) (Datablock, bool) {
+	columnIndexes := make(map[string]int)
+	for _, header := range rule.FilterCondition.columnHeaders() {
+		columnIndex := columnIndexForHeader(dataSourceDataBlock.ColumnList, header)
+		if columnIndex == -1 {
+			return dataSourceDataBlock, false
+		}
+		columnIndexes[header] = columnIndex
+	}
+
+	var rowData = make(map[int][]interface{})
+	dblockRows := dataSourceDataBlock.Rowdata
+	for _, k := range sortedKeysForDataBlockData(dblockRows) {
+		if rule.FilterCondition.matches(dblockRows[k], columnIndexes) {
+			rowData[k] = dblockRows[k]
+		}
+	}
+
+	return Datablock{
+		Title:       dataSourceDataBlock.Title,
+		ColumnList:  dataSourceDataBlock.ColumnList,
+		ColumnTypes: dataSourceDataBlock.ColumnTypes,
+		RowList:     dataSourceDataBlock.RowList,
+		Rowdata:     rowData,
+		UpdatedTime: dataSourceDataBlock.UpdatedTime,
+	}, true
+}
+
+// the column headers the condition and the conditions it combines compare
+func (condition FilterCondition) columnHeaders() []string {
+	var headers []string
+	for _, combined := range append(append([]FilterCondition{}, condition.And...), condition.Or...) {
+		headers = append(headers, combined.columnHeaders()...)
+	}
+	if condition.Not != nil {
+		headers = append(headers, condition.Not.columnHeaders()...)
+	}
+	if condition.ColumnHeader != "" {
+		headers = append(headers, condition.ColumnHeader)
+	}
+	return headers
+}
+
+// reports if the row matches the condition, columnIndexes has the index of every column the condition compares
+func (condition FilterCondition) matches(row []interface{}, columnIndexes map[string]int) bool {
+	switch {
+	case condition.And != nil:
+		for _, combined := range condition.And {
+			if !combined.matches(row, columnIndexes) {
+				return false
+			}
+		}
+		return true
+	case condition.Or != nil:
+		for _, combined := range condition.Or {
+			if combined.matches(row, columnIndexes) {
+				return true
+			}
+		}
+		return false
+	case condition.Not != nil:
+		return !condition.Not.matches(row, columnIndexes)
+	}
+
+	value := rowValue(row, columnIndexes[condition.ColumnHeader])
+	if condition.Operator == "is null" {
+		return value == nil
+	}
+	if value == nil {
+		return false
+	}
+
+	switch condition.Operator {
+	case "between":
+		if len(condition.Values) != 2 {
+			return false
+		}
+		low, lowOK := compareValues(value, condition.Values[0])
+		high, highOK := compareValues(value, condition.Values[1])
+		return lowOK && highOK && low >= 0 && high <= 0
+	case "in":
+		for _, operand := range condition.Values {
+			if result, ok := compareValues(value, operand); ok && result == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	result, ok := compareValues(value, condition.Value)
+	if !ok {
+		return false
+	}
+	switch condition.Operator {
+	case "=":
+		return result == 0
+	case "!=":
+		return result != 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	}
+	return false
+}
+
+// compares the value of a column to a value of a condition, -1, 0 or 1 for less, equal or greater. False
+// if they can't be compared (a time to a value that isn't a time, or either is nil)
+func compareValues(value interface{}, operand interface{}) (int, bool) {
+	if value == nil || operand == nil {
+		return 0, false
+	}
+	if valueTime, ok := value.(time.Time); ok {
+		operandTime, ok := timeFromValue(operand)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case valueTime.Before(operandTime):
+			return -1, true
+		case valueTime.After(operandTime):
+			return 1, true
+		}
+		return 0, true
+	}
+
+	if valueNumber, ok := numericValue(value); ok {
+		operandNumber, ok := numericValue(operand)
+		if operandString, isString := operand.(string); isString {
+			operandNumber, ok = parseFloat(operandString)
+		}
+		if ok {
+			switch {
+			case valueNumber < operandNumber:
+				return -1, true
+			case valueNumber > operandNumber:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	return strings.Compare(variableValueString(value), variableValueString(operand)), true
+}
+
+// the string as a float64 if it is a number
+func parseFloat(text string) (float64, bool) {
+	number, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	return number, err == nil
+}
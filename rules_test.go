@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{"one value", []float64{7}, 95, 7},
+		{"min", []float64{3, 1, 2}, 0, 1},
+		{"max", []float64{3, 1, 2}, 100, 3},
+		{"median of an odd count", []float64{5, 1, 3}, 50, 3},
+		{"median of an even count interpolates", []float64{4, 1, 3, 2}, 50, 2.5},
+		{"p95 interpolates", []float64{10, 20, 30, 40, 50}, 95, 48},
+		{"p90 on a rank", []float64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 110}, 90, 100},
+		{"duplicates", []float64{2, 2, 2, 9}, 50, 2},
+		{"below 0 is clamped to the min", []float64{3, 1, 2}, -10, 1},
+		{"above 100 is clamped to the max", []float64{3, 1, 2}, 150, 3},
+		{"NaN is clamped to the min", []float64{3, 1, 2}, math.NaN(), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := percentile(test.values, test.p); math.Abs(got-test.want) > 1e-9 {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPercentileLeavesValuesUnsorted(t *testing.T) {
+	values := []float64{3, 1, 2}
+	percentile(values, 50)
+	if values[0] != 3 || values[1] != 1 || values[2] != 2 {
+		t.Fatalf("percentile sorted its input: %v", values)
+	}
+}
+
+// rows of time, value for the values, a nil value is a row without a number
+func lttbTestRows(values ...interface{}) ([][]interface{}, []int64) {
+	var rows [][]interface{}
+	var times []int64
+	for i, value := range values {
+		rows = append(rows, []interface{}{int64(i * 1000), value})
+		times = append(times, int64(i*1000))
+	}
+	return rows, times
+}
+
+func TestLTTBRows(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    []interface{}
+		threshold int
+		want      []interface{} // the values of the picked rows, nil if the rows are kept as they are
+	}{
+		{"no threshold", []interface{}{1.0, 2.0, 3.0}, 0, nil},
+		{"no more rows than the threshold", []interface{}{1.0, 2.0, 3.0}, 3, nil},
+		{"threshold 1 keeps the first", []interface{}{1.0, 5.0, 2.0, 4.0}, 1, []interface{}{1.0}},
+		{"threshold 2 keeps the first and last", []interface{}{1.0, 5.0, 2.0, 4.0}, 2, []interface{}{1.0, 4.0}},
+		{"threshold 3 keeps the peak", []interface{}{1.0, 2.0, 9.0, 2.0, 1.0}, 3, []interface{}{1.0, 9.0, 1.0}},
+		{"threshold 3 keeps the dip", []interface{}{5.0, 5.0, 5.0, -4.0, 5.0, 5.0}, 3, []interface{}{5.0, -4.0, 5.0}},
+		{"buckets keep each peak", []interface{}{0.0, 8.0, 0.0, 0.0, 0.0, 0.0, -8.0, 0.0}, 4, []interface{}{0.0, 8.0, -8.0, 0.0}},
+		{"nil values are left out", []interface{}{1.0, nil, 9.0, nil, 1.0}, 3, []interface{}{1.0, 9.0, 1.0}},
+		{"nil values don't count toward the threshold", []interface{}{1.0, nil, 9.0, nil, 1.0, 2.0}, 4, []interface{}{1.0, 9.0, 1.0, 2.0}},
+		{"nil first and last values", []interface{}{nil, 1.0, 2.0, 9.0, 2.0, 1.0, nil}, 3, []interface{}{1.0, 9.0, 1.0}},
+		{"only nil values", []interface{}{nil, nil, nil, nil}, 2, []interface{}{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows, times := lttbTestRows(test.values...)
+			sampled := lttbRows(rows, times, 1, test.threshold)
+			if test.want == nil {
+				if sampled != nil {
+					t.Fatalf("got %v, want the rows kept", sampled)
+				}
+				return
+			}
+			if sampled == nil || len(sampled) != len(test.want) {
+				t.Fatalf("got %v, want values %v", sampled, test.want)
+			}
+			for i, row := range sampled {
+				if row[1] != test.want[i] {
+					t.Fatalf("got %v, want values %v", sampled, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterRuleConditions(t *testing.T) {
+	at := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	datablock := Datablock{
+		ColumnList: []string{"name", "status", "duration", "at"},
+		Rowdata: map[int][]interface{}{
+			1: {"a", "OK", int64(10), at},
+			2: {"b", "FAILED", int64(45), at.Add(time.Hour)},
+			3: {"c", "OK", 60.5, at.Add(2 * time.Hour)},
+			4: {"d", nil, int64(5), at.Add(3 * time.Hour)},
+			5: {"e", "TIMEOUT", nil, nil},
+		},
+	}
+
+	tests := []struct {
+		name string
+		rule string
+		want []string // the names of the rows kept
+	}{
+		{"comparison", `{"column_header": "duration", "operator": ">", "value": 30}`, []string{"b", "c"}},
+		{"number in a string", `{"column_header": "duration", "operator": "<=", "value": "10"}`, []string{"a", "d"}},
+		{"nil doesn't match a comparison", `{"column_header": "status", "operator": "!=", "value": "OK"}`, []string{"b", "e"}},
+		{"is null", `{"column_header": "status", "operator": "is null"}`, []string{"d"}},
+		{"in", `{"column_header": "status", "operator": "in", "values": ["FAILED", "TIMEOUT"]}`, []string{"b", "e"}},
+		{"between times", `{"column_header": "at", "operator": "between", "values": ["2026-10-17T13:00:00Z", "2026-10-17T14:00:00Z"]}`,
+			[]string{"b", "c"}},
+		{"and", `{"and": [{"column_header": "status", "operator": "=", "value": "OK"},
+			{"column_header": "duration", "operator": ">", "value": 30}]}`, []string{"c"}},
+		{"or", `{"or": [{"column_header": "status", "operator": "=", "value": "FAILED"},
+			{"column_header": "duration", "operator": "<", "value": 10}]}`, []string{"b", "d"}},
+		{"not", `{"not": {"column_header": "status", "operator": "=", "value": "OK"}}`, []string{"b", "d", "e"}},
+		{"not of is null", `{"not": {"column_header": "duration", "operator": "is null"}}`, []string{"a", "b", "c", "d"}},
+		{"nested", `{"or": [
+			{"and": [{"column_header": "status", "operator": "=", "value": "OK"},
+				{"not": {"column_header": "duration", "operator": "<", "value": 30}}]},
+			{"column_header": "status", "operator": "is null"}]}`, []string{"c", "d"}},
+		{"and of one", `{"and": [{"column_header": "name", "operator": "=", "value": "a"}]}`, []string{"a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rule FilterRowCompareRule
+			if err := json.Unmarshal([]byte(test.rule), &rule); err != nil {
+				t.Fatal(err)
+			}
+			if problems := rule.ValidateRule(datablock.ColumnList); len(problems) > 0 {
+				t.Fatalf("valid rule has problems %v", problems)
+			}
+			filtered, ok := rule.ApplyRuleToDataBlock(datablock)
+			if !ok {
+				t.Fatal("rule wasn't applied")
+			}
+			var names []string
+			for _, k := range sortedKeysForDataBlockData(filtered.Rowdata) {
+				names = append(names, filtered.Rowdata[k][0].(string))
+			}
+			if strings.Join(names, ",") != strings.Join(test.want, ",") {
+				t.Fatalf("kept %v, want %v", names, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterRuleValidation(t *testing.T) {
+	columnList := []string{"status", "duration"}
+	tests := []struct {
+		name  string
+		rule  string
+		field string // the field of the first problem
+	}{
+		{"comparison and combinator", `{"column_header": "status", "operator": "=", "value": "OK",
+			"and": [{"column_header": "duration", "operator": ">", "value": 1}]}`, ""},
+		{"two combinators", `{"and": [{"column_header": "status", "operator": "is null"}],
+			"not": {"column_header": "status", "operator": "is null"}}`, ""},
+		{"empty and", `{"and": []}`, "and"},
+		{"empty or", `{"or": []}`, "or"},
+		{"nested unknown column", `{"or": [{"column_header": "status", "operator": "is null"},
+			{"not": {"column_header": "missing", "operator": "is null"}}]}`, "or[1].not.column_header"},
+		{"nested unknown operator", `{"and": [{"column_header": "status", "operator": "like", "value": "O%"}]}`, "and[0].operator"},
+		{"between without two values", `{"not": {"column_header": "duration", "operator": "between", "values": [1]}}`, "not.values"},
+		{"missing value", `{"column_header": "status", "operator": "="}`, "value"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rule FilterRowCompareRule
+			if err := json.Unmarshal([]byte(test.rule), &rule); err != nil {
+				t.Fatal(err)
+			}
+			problems := rule.ValidateRule(columnList)
+			if len(problems) == 0 {
+				t.Fatal("invalid rule has no problems")
+			}
+			if problems[0].Field != test.field {
+				t.Fatalf("first problem is %v, want a problem of %q", problems[0], test.field)
+			}
+		})
+	}
+}
+
+func TestSeriesRule(t *testing.T) {
+	at := time.Date(2026, 10, 17, 1, 0, 0, 0, time.UTC)
+	datablock := Datablock{
+		ColumnList: []string{"ts", "host", "cpu", "mem"},
+		Rowdata: map[int][]interface{}{
+			1: {at, "web1", 10.0, 1.0},
+			2: {at, "web2", 20.0, 2.0},
+			3: {at.Add(time.Minute), "web1", 11.0, 3.0},
+			4: {at.Add(time.Minute), "web3"}, // shorter than the column list
+		},
+	}
+
+	tests := []struct {
+		name        string
+		rule        GrafanaMultiSeriesRule
+		datablock   Datablock
+		wantColumns []string
+		wantRows    [][]interface{}
+	}{
+		{"series column", GrafanaMultiSeriesRule{TimeColumnHeader: "ts", SeriesColumnHeader: "host", MetricColumnHeaders: []string{"cpu"}},
+			datablock, []string{"ts", "web1", "web2", "web3"},
+			[][]interface{}{{at, 10.0, 20.0, nil}, {at.Add(time.Minute), 11.0, nil, nil}}},
+		{"series column and metrics", GrafanaMultiSeriesRule{TimeColumnHeader: "ts", SeriesColumnHeader: "host", MetricColumnHeaders: []string{"cpu", "mem"}},
+			Datablock{ColumnList: datablock.ColumnList, Rowdata: map[int][]interface{}{1: {at, "web1", 10.0, 1.0}}},
+			[]string{"ts", "web1 cpu", "web1 mem"}, [][]interface{}{{at, 10.0, 1.0}}},
+		{"metrics without a series column", GrafanaMultiSeriesRule{TimeColumnHeader: "ts", MetricColumnHeaders: []string{"cpu", "mem"}},
+			Datablock{ColumnList: datablock.ColumnList, Rowdata: map[int][]interface{}{1: {at, "web1", 10.0, 1.0}, 2: {at.Add(time.Minute), "web1", 11.0}}},
+			[]string{"ts", "cpu", "mem"}, [][]interface{}{{at, 10.0, 1.0}, {at.Add(time.Minute), 11.0, nil}}},
+		{"no rows without a series column", GrafanaMultiSeriesRule{TimeColumnHeader: "ts", MetricColumnHeaders: []string{"cpu", "mem"}},
+			Datablock{ColumnList: datablock.ColumnList, Rowdata: map[int][]interface{}{}}, []string{"ts", "cpu", "mem"}, nil},
+		{"no rows with a series column", GrafanaMultiSeriesRule{TimeColumnHeader: "ts", SeriesColumnHeader: "host", MetricColumnHeaders: []string{"cpu"}},
+			Datablock{ColumnList: datablock.ColumnList, Rowdata: map[int][]interface{}{}}, []string{"ts"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, applied := test.rule.ApplyRuleToDataBlock(test.datablock)
+			if !applied || !got.multiSeries {
+				t.Fatalf("rule applied %v, multi series %v", applied, got.multiSeries)
+			}
+			if strings.Join(got.ColumnList, ",") != strings.Join(test.wantColumns, ",") {
+				t.Fatalf("got columns %v, want %v", got.ColumnList, test.wantColumns)
+			}
+			if len(got.Rowdata) != len(test.wantRows) {
+				t.Fatalf("got rows %v, want %v", got.Rowdata, test.wantRows)
+			}
+			for i, wantRow := range test.wantRows {
+				if !reflect.DeepEqual(got.Rowdata[i+1], wantRow) {
+					t.Fatalf("got row %d %v, want %v", i+1, got.Rowdata[i+1], wantRow)
+				}
+			}
+		})
+	}
+}
+
+func TestSeriesRuleColumnsAreValidatedForLaterRules(t *testing.T) {
+	var dSelector DataSelector
+	err := json.Unmarshal([]byte(`{"name": "d", "query_name": "q", "rules": [
+		{"rule_type": "seriesrule", "time_column_header": "ts", "metric_column_headers": ["cpu", "mem"]},
+		{"rule_type": "downsamplerule", "time_column_header": "ts", "method": "lttb", "value_column_header": "cpu"}]}`), &dSelector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := &Query{Name: "q", ColumnList: []string{"ts", "cpu", "mem"}}
+	if problems := validateDataSelectorRules("dataselector/d.json", &dSelector, query); len(problems) != 0 {
+		t.Fatalf("valid rules got problems %v", problems)
+	}
+
+	dSelector.RuleSet.Rules[1] = DownsampleRule{RuleType: "downsamplerule", TimeColumnHeader: "ts", Method: "lttb", ValueColumnHeader: "disk"}
+	if problems := validateDataSelectorRules("dataselector/d.json", &dSelector, query); len(problems) != 1 {
+		t.Fatalf("a column the seriesrule doesn't make got problems %v", problems)
+	}
+}
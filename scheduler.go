@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// used for a database whose cfg doesn't set max_concurrent_queries
+const defaultMaxConcurrentQueries = 2
+
+// how often the scheduler looks for cache entries that are due a refresh
+const schedulerTickInterval = time.Second
+
+// cache entries stop being refreshed and are dropped when no request has used them for this long, so
+// queries nobody is looking at don't keep running on the databases
+const idleCacheEntryTimeout = 15 * time.Minute
+
+// Scheduler refreshes the cached datablocks of every query on its RefreshTime, so requests are served from
+// the cache instead of waiting on the database
+type Scheduler struct {
+	refreshes       sync.WaitGroup
+	refreshCtx      context.Context // the context the refreshes are started with, cancelled by Shutdown
+	cancelRefreshes context.CancelFunc
+	stopped         chan struct{} // closed when Run returns
+}
+
+func newScheduler() *Scheduler {
+	refreshCtx, cancelRefreshes := context.WithCancel(context.Background())
+	return &Scheduler{
+		refreshCtx:      refreshCtx,
+		cancelRefreshes: cancelRefreshes,
+		stopped:         make(chan struct{}),
+	}
+}
+
+// runs the scheduler until the context is cancelled. Refreshes already started keep running, use Shutdown
+// to wait for them
+func (s *Scheduler) Run(ctx context.Context) {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(schedulerTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.dispatchDueRefreshes(s.refreshCtx)
+		}
+	}
+}
+
+// waits for Run to return (its context must be cancelled first) and for the refreshes it started to finish.
+// If the context is done first the remaining refreshes are cancelled, unless a request is waiting on them
+// as well, and the error is the context's
+func (s *Scheduler) Shutdown(ctx context.Context) error {
+	<-s.stopped
+
+	drained := make(chan struct{})
+	go func() {
+		s.refreshes.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		s.cancelRefreshes()
+		return nil
+	case <-ctx.Done():
+		s.cancelRefreshes()
+		return ctx.Err()
+	}
+}
+
+// starts a refresh for every cache entry of the current config whose next refresh time has passed
+func (s *Scheduler) dispatchDueRefreshes(ctx context.Context) {
+	cfg := currentConfig()
+	now := time.Now()
+
+	for _, query := range cfg.queryMap {
+		db, found := cfg.dbMap[query.DatabaseName]
+		if !found {
+			continue
+		}
+
+		// a query without parameters has exactly one entry, create it so it is loaded before the first request
+		defaultParams := defaultQueryParameters()
+		if defaultParams.cacheKey(query.QueryString) == "" {
+			query.preloadCacheEntry("", defaultParams)
+		}
+		query.removeIdleCacheEntries(idleCacheEntryTimeout)
+
+		for _, entry := range query.cacheEntries() {
+			// an entry dispatched twice before its refresh starts just shares the one refresh
+			if entry.isDue(now) {
+				s.refreshes.Add(1)
+				go func(query *Query, entry *QueryCacheEntry) {
+					defer s.refreshes.Done()
+					entry.refresh(ctx, db, query)
+				}(query, entry)
+			}
+		}
+	}
+}
+
+// the refresh interval plus up to 10% jitter, so queries with the same refresh time don't all hit the
+// databases in the same second
+func nextRefreshTime(interval time.Duration) time.Time {
+	if interval < schedulerTickInterval {
+		interval = schedulerTickInterval
+	}
+	jitter := time.Duration(rand.Int63n(int64(interval/10) + 1))
+	return time.Now().Add(interval + jitter)
+}
+
+type QueryStatus struct {
+	Name         string                  `json:"name"`
+	DatabaseName string                  `json:"database_name"`
+	RefreshTime  int                     `json:"refresh_time"`
+	CacheEntries []QueryCacheEntryStatus `json:"cache_entries"`
+}
+
+type QueryCacheEntryStatus struct {
+	Key             string    `json:"key"`
+	Running         bool      `json:"running"`
+	LastRunTime     time.Time `json:"last_run_time"`
+	LastDurationMS  int64     `json:"last_duration_ms"`
+	LastError       string    `json:"last_error,omitempty"`
+	RowCount        int       `json:"row_count"`
+	LastSuccessTime time.Time `json:"last_success_time"`
+	NextRefreshTime time.Time `json:"next_refresh_time"`
+}
+
+func queryStatus(v *Query) QueryStatus {
+	status := QueryStatus{
+		Name:         v.Name,
+		DatabaseName: v.DatabaseName,
+		RefreshTime:  v.RefreshTime,
+		CacheEntries: []QueryCacheEntryStatus{},
+	}
+
+	for key, entry := range v.cacheEntries() {
+		status.CacheEntries = append(status.CacheEntries, entry.status(key))
+	}
+	sort.Slice(status.CacheEntries, func(i, j int) bool {
+		return status.CacheEntries[i].Key < status.CacheEntries[j].Key
+	})
+	return status
+}
+
+func getQueryStatusListHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+
+	statuses := []QueryStatus{}
+	for _, query := range cfg.queryMap {
+		statuses = append(statuses, queryStatus(query))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	writeJSONResponse(w, statuses)
+}
+
+func getQueryStatusHandler(w http.ResponseWriter, r *http.Request) {
+	queryName := chi.URLParam(r, "queryName")
+
+	query, found := currentConfig().queryMap[queryName]
+	if found != true {
+		http.Error(w, "Could not find query in query map "+queryName, http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, queryStatus(query))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNextRefreshTime(t *testing.T) {
+	tests := []struct {
+		name        string
+		refreshTime int
+		want        time.Duration
+	}{
+		{"refresh time", 30, 30 * time.Second},
+		{"missing refresh time", 0, defaultRefreshTime},
+		{"negative refresh time", -5, defaultRefreshTime},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := &Query{RefreshTime: test.refreshTime}
+			if interval := query.refreshInterval(); interval != test.want {
+				t.Fatalf("got %v, want %v", interval, test.want)
+			}
+			until := time.Until(nextRefreshTime(query.refreshInterval()))
+			if until < test.want-time.Second || until > test.want+test.want/10+time.Second {
+				t.Fatalf("next refresh in %v, want %v plus up to 10%% jitter", until, test.want)
+			}
+		})
+	}
+}
+
+func TestIdleQueriesWithoutParametersStopRefreshing(t *testing.T) {
+	cfgRoot := newTestCfg(t)
+	defer loadTestCfg(t, cfgRoot)()
+	query := currentConfig().queryMap["q"]
+
+	scheduler := newScheduler()
+	scheduler.dispatchDueRefreshes(context.Background())
+	scheduler.refreshes.Wait()
+	entry, found := query.cacheEntries()[""]
+	if !found {
+		t.Fatal("the query without parameters wasn't loaded before the first request")
+	}
+	if datablock, _ := entry.snapshot(); datablock == nil {
+		t.Fatal("the preloaded entry wasn't refreshed")
+	}
+
+	// nobody requests it, so once idle it is dropped and not created again
+	entry.lock.Lock()
+	entry.lastAccessTime = time.Now().Add(-idleCacheEntryTimeout - time.Minute)
+	entry.nextRefreshTime = time.Time{}
+	entry.lock.Unlock()
+	scheduler.dispatchDueRefreshes(context.Background())
+	scheduler.refreshes.Wait()
+	if entries := query.cacheEntries(); len(entries) != 0 {
+		t.Fatalf("the idle entry is still refreshed: %v", entries)
+	}
+
+	// a request loads it again
+	if _, err, loaded := getDatablockAndUpdateIfNeeded(context.Background(), currentConfig().dbMap["demo"], query,
+		defaultQueryParameters()); err != nil || !loaded {
+		t.Fatalf("request after the entry was dropped: loaded %v, %v", loaded, err)
+	}
+	scheduler.dispatchDueRefreshes(context.Background())
+	scheduler.refreshes.Wait()
+	if _, found := query.cacheEntries()[""]; !found {
+		t.Fatal("the requested entry isn't refreshed")
+	}
+}
+
+func TestQueryWithoutRefreshTimeIsAProblem(t *testing.T) {
+	for _, refreshTime := range []int{0, -1} {
+		problems := validateQuery("query/q.json", &Query{Name: "q", RefreshTime: refreshTime})
+		if len(problems) != 1 || problems[0].Field != "refresh_time" {
+			t.Fatalf("refresh_time %d got problems %v", refreshTime, problems)
+		}
+	}
+	if problems := validateQuery("query/q.json", &Query{Name: "q", RefreshTime: 30}); len(problems) != 0 {
+		t.Fatalf("valid query got problems %v", problems)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const redactedSecret = "********"
+
+// Secret is a credential from a cfg file. In the cfg it is either the value itself, ${ENV_VAR} to read it
+// from an environment variable, or file:/path/to/file to read it from a file (e.g. a docker/kubernetes
+// secret under /run/secrets). A Secret prints and marshals as ******** so it is never echoed back by
+// accident, use string(secret) for the value
+type Secret string
+
+var secretEnvVarRegex = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// returns the secret with its reference (if any) replaced by the value it refers to
+func (s Secret) resolve() (Secret, error) {
+	value := string(s)
+
+	if match := secretEnvVarRegex.FindStringSubmatch(value); match != nil {
+		envValue, found := os.LookupEnv(match[1])
+		if !found {
+			return "", errors.New("environment variable " + match[1] + " is not set")
+		}
+		return Secret(envValue), nil
+	}
+
+	if strings.HasPrefix(value, "file:") {
+		path := strings.TrimPrefix(value, "file:")
+		fileValue, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		// secret files are usually written with a trailing newline
+		return Secret(strings.TrimRight(string(fileValue), "\r\n")), nil
+	}
+
+	return s, nil
+}
+
+func (s Secret) String() string {
+	return redactedSecret
+}
+
+func (s Secret) GoString() string {
+	return redactedSecret
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redactedSecret + `"`), nil
+}
+
+// resolves both secrets of a username/password pair
+func resolveCredentials(username *Secret, password *Secret) error {
+	var err error
+	*username, err = username.resolve()
+	if err != nil {
+		return errors.New("username: " + err.Error())
+	}
+	*password, err = password.resolve()
+	if err != nil {
+		return errors.New("password: " + err.Error())
+	}
+	return nil
+}
+
+// returns the error with any of the secrets in its message replaced, drivers can include the connection
+// string (and so the password) in their errors
+func redactError(err error, secrets ...Secret) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	redacted := message
+	for _, secret := range secrets {
+		if len(secret) > 0 {
+			redacted = strings.Replace(redacted, string(secret), redactedSecret, -1)
+		}
+	}
+	if redacted == message {
+		return err
+	}
+	return errors.New(redacted)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ServerConfig is how the server is run, read from the -config json file with any flags given on the
+// command line taking precedence over the file
+type ServerConfig struct {
+	ListenAddress   string `json:"listen_address"`
+	CfgRoot         string `json:"cfg_root"`      // the folder holding the db, query, dataselector and variable folders
+	TLSCertFile     string `json:"tls_cert_file"` // serve https when both the cert and key file are set
+	TLSKeyFile      string `json:"tls_key_file"`
+	ReadTimeout     int    `json:"read_timeout"`     // seconds to read a request, 0 is no limit
+	WriteTimeout    int    `json:"write_timeout"`    // seconds to write a response (including waiting on a query), 0 is no limit
+	ShutdownTimeout int    `json:"shutdown_timeout"` // seconds to wait for in-flight requests and refreshes on shutdown
+	Strict          bool   `json:"strict"`           // refuse to start, and keep the current config on reload, if the cfg has any problems
+	AllowAnonymous  bool   `json:"allow_anonymous"`  // let requests without credentials through, never as an admin and only to the dataselectors every client may use
+	LogLevel        string `json:"log_level"`        // debug, info, warn or error
+	LogFormat       string `json:"log_format"`       // text or json
+
+	// the cors policy, replaced by the profile named by cors_profile if that is set so one file can hold
+	// the policies of every environment e.g. {"development": {...}, "production": {...}}
+	CORS         CORSConfig            `json:"cors"`
+	CORSProfiles map[string]CORSConfig `json:"cors_profiles"`
+	CORSProfile  string                `json:"cors_profile"`
+}
+
+// environment variable naming the cors profile to use when the -cors-profile flag isn't given
+const corsProfileEnvVar = "DASHBOARD_CORS_PROFILE"
+
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ListenAddress:   ":9999",
+		CfgRoot:         "./cfg/",
+		ReadTimeout:     30,
+		WriteTimeout:    150, // longer than the default query timeout so the first load of a query can finish
+		ShutdownTimeout: 30,
+		LogLevel:        "info",
+		LogFormat:       "text",
+	}
+}
+
+// parses the command line into the server config and returns the remaining (non flag) arguments
+func parseServerConfig(args []string) (ServerConfig, []string, error) {
+	serverCfg := defaultServerConfig()
+	flags := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: dashboard [flags] [validate]")
+		fmt.Fprintln(flags.Output(), "  validate: check the cfg folders, print every problem found and exit")
+		flags.PrintDefaults()
+	}
+
+	configFile := flags.String("config", "", "json file with the server config, the flags below override it")
+	var flagCfg ServerConfig
+	flags.StringVar(&flagCfg.ListenAddress, "listen", serverCfg.ListenAddress, "address to listen on")
+	flags.StringVar(&flagCfg.CfgRoot, "cfg", serverCfg.CfgRoot, "folder holding the db, query, dataselector and variable folders")
+	flags.StringVar(&flagCfg.TLSCertFile, "tls-cert", "", "certificate file, serve https when set along with -tls-key")
+	flags.StringVar(&flagCfg.TLSKeyFile, "tls-key", "", "private key file of the -tls-cert certificate")
+	flags.IntVar(&flagCfg.ReadTimeout, "read-timeout", serverCfg.ReadTimeout, "seconds to read a request, 0 is no limit")
+	flags.IntVar(&flagCfg.WriteTimeout, "write-timeout", serverCfg.WriteTimeout, "seconds to write a response, 0 is no limit")
+	flags.IntVar(&flagCfg.ShutdownTimeout, "shutdown-timeout", serverCfg.ShutdownTimeout, "seconds to wait for in-flight requests and queries on shutdown")
+	flags.BoolVar(&flagCfg.Strict, "strict", false, "refuse to start, and keep the current config on reload, if the cfg has any problems")
+	flags.BoolVar(&flagCfg.AllowAnonymous, "allow-anonymous", false, "let requests without credentials through, with the access every client has and never as an admin")
+	flags.StringVar(&flagCfg.LogLevel, "log-level", serverCfg.LogLevel, "debug, info, warn or error")
+	flags.StringVar(&flagCfg.LogFormat, "log-format", serverCfg.LogFormat, "text or json")
+	flags.StringVar(&flagCfg.CORSProfile, "cors-profile", "", "cors profile of the config file to use, defaults to $"+corsProfileEnvVar)
+
+	if err := flags.Parse(args); err != nil {
+		return serverCfg, nil, err
+	}
+
+	if *configFile != "" {
+		jsonData, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return serverCfg, nil, err
+		}
+		if err := json.Unmarshal(jsonData, &serverCfg); err != nil {
+			return serverCfg, nil, errors.New(*configFile + ": " + err.Error())
+		}
+	}
+
+	// only the flags given on the command line override the file
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			serverCfg.ListenAddress = flagCfg.ListenAddress
+		case "cfg":
+			serverCfg.CfgRoot = flagCfg.CfgRoot
+		case "tls-cert":
+			serverCfg.TLSCertFile = flagCfg.TLSCertFile
+		case "tls-key":
+			serverCfg.TLSKeyFile = flagCfg.TLSKeyFile
+		case "read-timeout":
+			serverCfg.ReadTimeout = flagCfg.ReadTimeout
+		case "write-timeout":
+			serverCfg.WriteTimeout = flagCfg.WriteTimeout
+		case "shutdown-timeout":
+			serverCfg.ShutdownTimeout = flagCfg.ShutdownTimeout
+		case "strict":
+			serverCfg.Strict = flagCfg.Strict
+		case "allow-anonymous":
+			serverCfg.AllowAnonymous = flagCfg.AllowAnonymous
+		case "log-level":
+			serverCfg.LogLevel = flagCfg.LogLevel
+		case "log-format":
+			serverCfg.LogFormat = flagCfg.LogFormat
+		case "cors-profile":
+			serverCfg.CORSProfile = flagCfg.CORSProfile
+		}
+	})
+	if profile := os.Getenv(corsProfileEnvVar); profile != "" && flagCfg.CORSProfile == "" {
+		serverCfg.CORSProfile = profile
+	}
+
+	corsCfg, err := serverCfg.corsConfig()
+	if err != nil {
+		return serverCfg, nil, err
+	}
+	serverCfg.CORS = corsCfg
+
+	if (serverCfg.TLSCertFile == "") != (serverCfg.TLSKeyFile == "") {
+		return serverCfg, nil, errors.New("both the tls cert file and tls key file must be set to serve https")
+	}
+	return serverCfg, flags.Args(), nil
+}
+
+func (serverCfg ServerConfig) useTLS() bool {
+	return serverCfg.TLSCertFile != "" && serverCfg.TLSKeyFile != ""
+}
+
+// runs the server until it fails or is sent SIGTERM/SIGINT. On a signal it stops accepting requests, waits
+// (up to the shutdown timeout) for the in-flight requests and query refreshes and closes every database
+func runServer(serverCfg ServerConfig) error {
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+
+	scheduler := newScheduler()
+	go watchConfig(runCtx, serverCfg.CfgRoot, serverCfg.Strict, cfgWatchInterval)
+	go scheduler.Run(runCtx)
+	go runHealthChecks(runCtx)
+
+	server := &http.Server{
+		Addr:         serverCfg.ListenAddress,
+		Handler:      registerRoutes(serverCfg),
+		ReadTimeout:  time.Duration(serverCfg.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(serverCfg.WriteTimeout) * time.Second,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if serverCfg.useTLS() {
+			serverErr <- server.ListenAndServeTLS(serverCfg.TLSCertFile, serverCfg.TLSKeyFile)
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+	logger.WithFields(logrus.Fields{
+		"address": serverCfg.ListenAddress,
+		"https":   serverCfg.useTLS(),
+	}).Info("Listening")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serverErr:
+		stopRunning()
+		closeAllDatabases()
+		return err
+	case sig := <-signals:
+		logger.WithField("signal", sig.String()).Info("Shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(serverCfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.WithError(err).Warn("Shutting down the server")
+	}
+	stopRunning()
+	if err := scheduler.Shutdown(shutdownCtx); err != nil {
+		logger.WithError(err).Warn("Cancelled the query refreshes still running")
+	}
+	closeAllDatabases()
+	logger.Info("Shut down")
+	return nil
+}
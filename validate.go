@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RuleError is a dataselector rule that could not be loaded, Field is the rule's json field it is about
+type RuleError struct {
+	Index   int
+	Field   string
+	Message string
+}
+
+func newRuleError(index int, err error) *RuleError {
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) {
+		return &RuleError{Index: index, Field: typeError.Field, Message: typeError.Error()}
+	}
+	return &RuleError{Index: index, Message: err.Error()}
+}
+
+func (e *RuleError) field() string {
+	return ruleField(e.Index, e.Field)
+}
+
+func (e *RuleError) Error() string {
+	return e.field() + ": " + e.Message
+}
+
+// returns the location of a rule's field in a dataselector json file e.g. rules[1].regex_string
+func ruleField(index int, field string) string {
+	if field == "" {
+		return fmt.Sprintf("rules[%d]", index)
+	}
+	return fmt.Sprintf("rules[%d].%s", index, field)
+}
+
+// returns the location of an item of a list field e.g. metric_column_headers[0]
+func ruleListField(field string, index int) string {
+	return fmt.Sprintf("%s[%d]", field, index)
+}
+
+// turns the error from unmarshalling a cfg file into a problem with the field or line it is about
+func jsonConfigProblem(path string, jsonData []byte, err error) ConfigProblem {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	var ruleError *RuleError
+
+	switch {
+	case errors.As(err, &ruleError):
+		return ConfigProblem{File: path, Field: ruleError.field(), Message: ruleError.Message}
+	case errors.As(err, &typeError):
+		return ConfigProblem{File: path, Field: typeError.Field, Message: typeError.Error()}
+	case errors.As(err, &syntaxError) && syntaxError.Offset <= int64(len(jsonData)):
+		before := jsonData[:syntaxError.Offset]
+		line := bytes.Count(before, []byte("\n")) + 1
+		column := len(before) - bytes.LastIndexByte(before, '\n') - 1
+		return ConfigProblem{File: path, Message: fmt.Sprintf("%s at line %d column %d", err, line, column)}
+	}
+	return ConfigProblem{File: path, Message: err.Error()}
+}
+
+// returns a problem if the header is set but is not one of the columns, an empty header is left to the
+// required field checks and a nil column list is columns that aren't known until the query has run
+func checkColumnHeader(field string, header string, columnList []string) []ConfigProblem {
+	if header == "" || columnList == nil || columnIndexForHeader(columnList, header) != -1 {
+		return nil
+	}
+	return []ConfigProblem{{
+		Field:   field,
+		Message: "Could not find column header " + header + " in column list [" + strings.Join(columnList, ", ") + "]",
+	}}
+}
+
+// implemented by rules whose columns depend on the rows (e.g. a column per series), the column headers of
+// the rules after them can't be checked
+type dataDependentColumnsRule interface {
+	columnsDependOnData() bool
+}
+
+// checks the rules of a dataselector against the column list of its query, query is nil if the
+// dataselector's query is missing (which is reported by itself)
+func validateDataSelectorRules(path string, dSelector *DataSelector, query *Query) []ConfigProblem {
+	var problems []ConfigProblem
+	rules := dSelector.RuleSet.Rules
+	if query == nil || len(rules) == 0 {
+		return nil
+	}
+	if len(query.ColumnList) == 0 {
+		return []ConfigProblem{{File: path, Field: "rules",
+			Message: "Query " + query.Name + " has no column_list for the rules to find their columns in"}}
+	}
+
+	// each rule sees the columns left by the rules before it
+	columnList := query.ColumnList
+	for i, rule := range rules {
+		for _, problem := range rule.ValidateRule(columnList) {
+			problem.File = path
+			problem.Field = ruleField(i, problem.Field)
+			problems = append(problems, problem)
+		}
+		if dataRule, ok := rule.(dataDependentColumnsRule); ok && dataRule.columnsDependOnData() {
+			columnList = nil
+		} else if columnList != nil {
+			datablock, _ := rule.ApplyRuleToDataBlock(Datablock{ColumnList: columnList, Rowdata: make(map[int][]interface{})})
+			columnList = datablock.ColumnList
+		}
+	}
+	return problems
+}
+
+// checks the settings of a query, a query without a refresh_time is refreshed every defaultRefreshTime
+func validateQuery(path string, query *Query) []ConfigProblem {
+	switch {
+	case query.RefreshTime == 0:
+		return []ConfigProblem{{File: path, Field: "refresh_time",
+			Message: fmt.Sprintf("Missing refresh_time, the query is refreshed every %d seconds", int(defaultRefreshTime.Seconds()))}}
+	case query.RefreshTime < 0:
+		return []ConfigProblem{{File: path, Field: "refresh_time",
+			Message: fmt.Sprintf("refresh_time must be positive, the query is refreshed every %d seconds", int(defaultRefreshTime.Seconds()))}}
+	}
+	return nil
+}
+
+// checks the column headers of a variable against the column list of its query
+func validateVariable(path string, variable *Variable, query *Query) []ConfigProblem {
+	if query == nil || len(query.ColumnList) == 0 {
+		return nil
+	}
+	var problems []ConfigProblem
+	for _, problem := range checkColumnHeader("value_column_header", variable.ValueColumnHeader, query.ColumnList) {
+		problem.File = path
+		problems = append(problems, problem)
+	}
+	for _, problem := range checkColumnHeader("text_column_header", variable.TextColumnHeader, query.ColumnList) {
+		problem.File = path
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// checks the column headers of an annotation against the column list of its query
+func validateAnnotation(path string, annotation *Annotation, query *Query) []ConfigProblem {
+	var problems []ConfigProblem
+	if annotation.TimeColumnHeader == "" {
+		problems = append(problems, ConfigProblem{File: path, Field: "time_column_header", Message: "Missing time_column_header"})
+	}
+	if query == nil || len(query.ColumnList) == 0 {
+		return problems
+	}
+	columns := append([][2]string{{"time_column_header", annotation.TimeColumnHeader}}, annotation.optionalColumns()...)
+	for _, column := range columns {
+		for _, problem := range checkColumnHeader(column[0], column[1], query.ColumnList) {
+			problem.File = path
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// the validate command, loads the cfg folders and prints every problem found. The exit code is 1 if there
+// are any problems
+func runValidateCommand(cfgRoot string) int {
+	cfg, problems, err := loadConfig(cfgRoot, nil)
+	if err != nil {
+		fmt.Println("Could not read cfg ", err)
+		return 1
+	}
+	closeUnusedDatabases(cfg, newConfig())
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Println(len(problems), " cfg problems found")
+		return 1
+	}
+	fmt.Println("cfg is valid: ", len(cfg.dbMap), " databases, ", len(cfg.queryMap), " queries, ",
+		len(cfg.dataSelectorMap), " dataselectors, ", len(cfg.variableMap), " variables, ", len(cfg.annotationMap), " annotations, ", len(cfg.clientMap), " clients")
+	return 0
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Variable is a grafana template variable whose values are a column of a query's results
+type Variable struct {
+	Name              string   `json:"name"`
+	QueryName         string   `json:"query_name"`
+	ValueColumnHeader string   `json:"value_column_header"` // defaults to the first column
+	TextColumnHeader  string   `json:"text_column_header"`  // defaults to the value column
+	AdhocColumn       string   `json:"adhoc_column"`        // column adhoc filters on this variable apply to, not an adhoc key if empty
+	AllowedClients    []string `json:"allowed_clients"`     // names of the clients that may list the variable's values
+	AllowedRoles      []string `json:"allowed_roles"`       // roles of the clients that may list the variable's values, both empty is everyone
+}
+
+type VariableValue struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+// grafana adhoc filter operators that can be bound as a plain sql comparison
+var adhocFilterOperators = map[string]string{
+	"=":  "=",
+	"!=": "<>",
+	"<":  "<",
+	">":  ">",
+	"<=": "<=",
+	">=": ">=",
+}
+
+// builds the query parameters (time range, scoped variables and adhoc filters) of a grafana query request
+func queryParametersFromGrafanaRequest(r GrafanaQueryRequest) (QueryParameters, error) {
+	timeRange, err := timeRangeFromGrafanaRequest(r)
+	if err != nil {
+		return QueryParameters{}, err
+	}
+
+	adhocConditions, err := resolveAdhocFilters(r.AdhocFilters)
+	if err != nil {
+		return QueryParameters{}, err
+	}
+
+	variables := make(map[string]interface{})
+	for name, scopedVar := range r.ScopedVars {
+		// the __ variables (__interval etc) are grafana's own and are handled by the $__ macros
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		variables[name] = scopedVar.Value
+	}
+
+	return QueryParameters{
+		TimeRange:     timeRange,
+		Variables:     variables,
+		AdhocFilters:  adhocConditions,
+		MaxDataPoints: r.MaxDataPoints,
+	}, nil
+}
+
+// builds the query parameters from the url parameters, from/to for the time range and var-<name> for
+// variables (repeat the parameter for a multi value variable) like grafana's own dashboard urls
+func queryParametersFromURL(r *http.Request) (QueryParameters, error) {
+	timeRange, err := timeRangeFromURL(r)
+	if err != nil {
+		return QueryParameters{}, err
+	}
+
+	variables := make(map[string]interface{})
+	for param, values := range r.URL.Query() {
+		if !strings.HasPrefix(param, "var-") {
+			continue
+		}
+		name := strings.TrimPrefix(param, "var-")
+		if len(values) == 1 {
+			variables[name] = values[0]
+		} else {
+			list := make([]interface{}, len(values))
+			for i := range values {
+				list[i] = values[i]
+			}
+			variables[name] = list
+		}
+	}
+
+	return QueryParameters{TimeRange: timeRange, Variables: variables}, nil
+}
+
+// adhoc filter keys must be variables with an adhoc column, the column name comes from the cfg and
+// never from the request so only the filter value (which is bound) is caller controlled
+func resolveAdhocFilters(filters []GrafanaAdhocFilter) ([]AdhocCondition, error) {
+	var conditions []AdhocCondition
+	for _, filter := range filters {
+		variable, found := currentConfig().variableMap[filter.Key]
+		if !found || variable.AdhocColumn == "" {
+			return nil, errors.New("Unknown adhoc filter key " + filter.Key)
+		}
+		operator, found := adhocFilterOperators[filter.Operator]
+		if !found {
+			return nil, errors.New("Unsupported adhoc filter operator " + filter.Operator)
+		}
+		conditions = append(conditions, AdhocCondition{
+			Column:   variable.AdhocColumn,
+			Operator: operator,
+			Value:    filter.Value,
+		})
+	}
+	return conditions, nil
+}
+
+// returns
+// the values of the variable, de-duplicated in query result order
+// http status code to use in rsp
+// error string to pass back if error
+func getVariableValues(ctx context.Context, variableName string, params QueryParameters) ([]VariableValue, int, string) {
+	cfg := currentConfig()
+	variable, found := cfg.variableMap[variableName]
+	if found != true {
+		return nil, http.StatusNotFound, "Could not find variable in variable map " + variableName
+	}
+	if httpCode, errorString := checkACLAccess(ctx, "variable "+variable.Name, variable.AllowedClients, variable.AllowedRoles); errorString != "" {
+		return nil, httpCode, errorString
+	}
+	query, found := cfg.queryMap[variable.QueryName]
+	if found != true {
+		return nil, http.StatusNotFound, "Could not find query in query map " + variable.QueryName
+	}
+	db, found := cfg.dbMap[query.DatabaseName]
+	if found != true {
+		return nil, http.StatusNotFound, "Could not find database in DB map " + query.DatabaseName
+	}
+
+	datablock, err, _ := getDatablockAndUpdateIfNeeded(ctx, db, query, params)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Error getting results from query " + err.Error()
+	}
+
+	valueColumnIndex := 0
+	if variable.ValueColumnHeader != "" {
+		valueColumnIndex = columnIndexForHeader(datablock.ColumnList, variable.ValueColumnHeader)
+	}
+	textColumnIndex := valueColumnIndex
+	if variable.TextColumnHeader != "" {
+		textColumnIndex = columnIndexForHeader(datablock.ColumnList, variable.TextColumnHeader)
+	}
+	if valueColumnIndex == -1 || textColumnIndex == -1 {
+		return nil, http.StatusInternalServerError, "Could not find variable columns in query " + query.Name
+	}
+
+	var values []VariableValue
+	seen := make(map[string]bool)
+	dblockRows := datablock.Rowdata
+	for _, k := range sortedKeysForDataBlockData(dblockRows) {
+		if valueColumnIndex >= len(dblockRows[k]) || textColumnIndex >= len(dblockRows[k]) {
+			continue
+		}
+		value := variableValueString(dblockRows[k][valueColumnIndex])
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		values = append(values, VariableValue{
+			Text:  variableValueString(dblockRows[k][textColumnIndex]),
+			Value: value,
+		})
+	}
+	return values, http.StatusOK, ""
+}
+
+// returns the index of the header in the column list or -1 if it isn't there
+func columnIndexForHeader(columnList []string, header string) int {
+	for i := range columnList {
+		if columnList[i] == header {
+			return i
+		}
+	}
+	return -1
+}
+
+func variableValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// the json datasource sends the variable query as payload.target, older versions send the payload as a string
+func (r GrafanaVariableRequest) target() string {
+	var payload struct {
+		Target string `json:"target"`
+	}
+	if err := json.Unmarshal(r.Payload, &payload); err == nil {
+		return payload.Target
+	}
+	var target string
+	json.Unmarshal(r.Payload, &target)
+	return target
+}
+
+func postVariableHandler(writer http.ResponseWriter, request *http.Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var variableRequest GrafanaVariableRequest
+	err = json.Unmarshal(body, &variableRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params := defaultQueryParameters()
+	params.TimeRange, err = timeRangeFromGrafanaRequest(GrafanaQueryRequest{Range: variableRequest.Range})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values, httpCode, errorString := getVariableValues(request.Context(), variableRequest.target(), params)
+	if errorString != "" {
+		http.Error(writer, errorString, httpCode)
+		return
+	}
+
+	var response []GrafanaVariableResponseElement
+	for _, value := range values {
+		response = append(response, GrafanaVariableResponseElement{Text: value.Text, Value: value.Value})
+	}
+	writeJSONResponse(writer, response)
+}
+
+func postTagKeysHandler(writer http.ResponseWriter, request *http.Request) {
+	client := clientFromContext(request.Context())
+	var tagKeys []GrafanaTagKey
+	for name, variable := range currentConfig().variableMap {
+		if variable.AdhocColumn != "" && client.allowedBy(variable.AllowedClients, variable.AllowedRoles) {
+			tagKeys = append(tagKeys, GrafanaTagKey{Type: "string", Text: name})
+		}
+	}
+	writeJSONResponse(writer, tagKeys)
+}
+
+func postTagValuesHandler(writer http.ResponseWriter, request *http.Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var tagValuesRequest GrafanaTagValuesRequest
+	err = json.Unmarshal(body, &tagValuesRequest)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values, httpCode, errorString := getVariableValues(request.Context(), tagValuesRequest.Key, defaultQueryParameters())
+	if errorString != "" {
+		http.Error(writer, errorString, httpCode)
+		return
+	}
+
+	var response []GrafanaTagValue
+	for _, value := range values {
+		response = append(response, GrafanaTagValue{Text: value.Value})
+	}
+	writeJSONResponse(writer, response)
+}
+
+func writeJSONResponse(writer http.ResponseWriter, response interface{}) {
+	writeJSONResponseWithCode(writer, response, http.StatusOK)
+}
+
+func writeJSONResponseWithCode(writer http.ResponseWriter, response interface{}, httpCode int) {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(httpCode)
+	writer.Write(responseJSON)
+}
+
+// *************Grafana variable json stuff
+type GrafanaSearchRequest struct {
+	Target string `json:"target"`
+}
+
+type GrafanaVariableRequest struct {
+	Payload json.RawMessage `json:"payload"`
+	Range   Range           `json:"range"`
+}
+
+type GrafanaVariableResponseElement struct {
+	Text  string `json:"__text"`
+	Value string `json:"__value"`
+}
+
+type GrafanaAdhocFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type GrafanaTagKey struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type GrafanaTagValuesRequest struct {
+	Key string `json:"key"`
+}
+
+type GrafanaTagValue struct {
+	Text string `json:"text"`
+}